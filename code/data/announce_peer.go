@@ -11,6 +11,7 @@ type AnnouncePeerRequest struct {
 		Hash    [20]byte `bencode:"info_hash"`
 		Implied int      `bencode:"implied_port"`
 		Port    uint16   `bencode:"port"`
+		Token   string   `bencode:"token"`
 	} `bencode:"a"`
 }
 
@@ -22,6 +23,25 @@ type AnnouncePeerResponse struct {
 	} `bencode:"r"`
 }
 
+// AnnouncePeerReq build announce_peer request packet
+func AnnouncePeerReq(id, hash [20]byte, port uint16, implied bool, token string) ([]byte, string, error) {
+	var req AnnouncePeerRequest
+	req.Hdr = newHdr(request)
+	req.Action = "announce_peer"
+	req.Data.ID = id
+	req.Data.Hash = hash
+	if implied {
+		req.Data.Implied = 1
+	}
+	req.Data.Port = port
+	req.Data.Token = token
+	data, err := bencode.Encode(req)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, req.Hdr.Transaction, nil
+}
+
 // AnnouncePeer build announce_peer response packet
 func AnnouncePeer(tx string, id [20]byte) ([]byte, error) {
 	var rep AnnouncePeerResponse
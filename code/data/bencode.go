@@ -1,7 +1,5 @@
 package data
 
-import "github.com/lwch/bencode"
-
 const (
 	request  = "q"
 	response = "r"
@@ -20,6 +18,20 @@ const (
 	TypeGetPeers ReqType = "get_peers"
 	// TypeAnnouncePeer announce_peer
 	TypeAnnouncePeer ReqType = "announce_peer"
+	// TypeSampleInfohashes sample_infohashes, http://www.bittorrent.org/beps/bep_0051.html
+	TypeSampleInfohashes ReqType = "sample_infohashes"
+	// TypeGet get, http://www.bittorrent.org/beps/bep_0044.html
+	TypeGet ReqType = "get"
+	// TypePut put, http://www.bittorrent.org/beps/bep_0044.html
+	TypePut ReqType = "put"
+)
+
+// http://www.bittorrent.org/beps/bep_0032.html
+const (
+	// WantNodes4 want ipv4 nodes
+	WantNodes4 = "n4"
+	// WantNodes6 want ipv6 nodes
+	WantNodes6 = "n6"
 )
 
 // Hdr bencode header
@@ -38,6 +50,11 @@ func (h Hdr) IsResponse() bool {
 	return h.Type == response
 }
 
+// IsError is error packet
+func (h Hdr) IsError() bool {
+	return h.Type == err
+}
+
 type reqData struct {
 	Action string      `bencode:"q"`
 	Data   interface{} `bencode:"a"`
@@ -65,11 +82,35 @@ func newRepData(data interface{}) repData {
 	return repData{Data: data}
 }
 
-// ParseReqType parse request type
-func ParseReqType(data []byte) ReqType {
-	var t struct {
-		Type ReqType `bencode:"q"`
+// Packet header, sender id and request type of krpc packet
+type Packet struct {
+	Hdr
+	ID    [20]byte // empty in error packet
+	Query ReqType  // empty when not request
+}
+
+// ParsePacket parse packet once for dispatching.
+// bep_0044 values may contain list in list which bencode library not supported,
+// so the raw decoder is used here
+func ParsePacket(data []byte) (Packet, error) {
+	var pkt Packet
+	v, e := Decode(data)
+	if e != nil {
+		return pkt, e
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return pkt, errInvalidPacket
+	}
+	pkt.Transaction, _ = dict["t"].(string)
+	pkt.Type, _ = dict["y"].(string)
+	body := dictOf(v, "a")
+	if pkt.IsRequest() {
+		q, _ := dict["q"].(string)
+		pkt.Query = ReqType(q)
+	} else if pkt.IsResponse() {
+		body = dictOf(v, "r")
 	}
-	bencode.Decode(data, &t)
-	return t.Type
+	copyString(pkt.ID[:], body, "id")
+	return pkt, nil
 }
@@ -0,0 +1,58 @@
+package data
+
+import "github.com/lwch/bencode"
+
+// http://www.bittorrent.org/beps/bep_0005.html#errors
+const (
+	// ErrGeneric generic error
+	ErrGeneric = 201
+	// ErrServer server error
+	ErrServer = 202
+	// ErrProtocol protocol error, such as a malformed packet, invalid arguments, or bad token
+	ErrProtocol = 203
+	// ErrMethodUnknown method unknown
+	ErrMethodUnknown = 204
+	// ErrMessageTooBig v is too big, http://www.bittorrent.org/beps/bep_0044.html#errors
+	ErrMessageTooBig = 205
+	// ErrInvalidSignature invalid signature
+	ErrInvalidSignature = 206
+	// ErrSaltTooBig salt is too big
+	ErrSaltTooBig = 207
+	// ErrCasMismatch cas mismatch
+	ErrCasMismatch = 301
+	// ErrSeqTooSmall sequence number less than current
+	ErrSeqTooSmall = 302
+)
+
+// ErrorResponse error response
+type ErrorResponse struct {
+	Hdr
+	Errors []interface{} `bencode:"e"`
+}
+
+// Code error code, 0 when missing
+func (rep ErrorResponse) Code() int {
+	if len(rep.Errors) == 0 {
+		return 0
+	}
+	code, _ := rep.Errors[0].(int)
+	return code
+}
+
+// Message error message
+func (rep ErrorResponse) Message() string {
+	if len(rep.Errors) < 2 {
+		return ""
+	}
+	msg, _ := rep.Errors[1].(string)
+	return msg
+}
+
+// ErrorRep build error response packet
+func ErrorRep(tx string, code int, msg string) ([]byte, error) {
+	var rep ErrorResponse
+	rep.Transaction = tx
+	rep.Type = err
+	rep.Errors = []interface{}{code, msg}
+	return bencode.Encode(rep)
+}
@@ -0,0 +1,31 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/lwch/bencode"
+)
+
+func TestErrorPacket(t *testing.T) {
+	buf, err := ErrorRep("aa", ErrMethodUnknown, "method unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := ParsePacket(buf)
+	if err != nil || !pkt.IsError() || pkt.Transaction != "aa" {
+		t.Fatalf("unexpected packet: %q", buf)
+	}
+	var rep ErrorResponse
+	err = bencode.Decode(buf, &rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Code() != ErrMethodUnknown || rep.Message() != "method unknown" {
+		t.Fatalf("unexpected error: %d %s", rep.Code(), rep.Message())
+	}
+	// missing code and message
+	var empty ErrorResponse
+	if empty.Code() != 0 || empty.Message() != "" {
+		t.Fatal("unexpected error of empty response")
+	}
+}
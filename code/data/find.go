@@ -11,6 +11,7 @@ type FindRequest struct {
 	Data   struct {
 		ID     [20]byte `bencode:"id"`
 		Target [20]byte `bencode:"target"`
+		Want   []string `bencode:"want"`
 	} `bencode:"a"`
 }
 
@@ -18,18 +19,20 @@ type FindRequest struct {
 type FindResponse struct {
 	Hdr
 	Response struct {
-		ID    [20]byte `bencode:"id"`
-		Nodes string   `bencode:"nodes"`
+		ID     [20]byte `bencode:"id"`
+		Nodes  string   `bencode:"nodes"`
+		Nodes6 string   `bencode:"nodes6"`
 	} `bencode:"r"`
 }
 
 // FindReq build find_node request packet
-func FindReq(id, target [20]byte) ([]byte, string, error) {
+func FindReq(id, target [20]byte, want []string) ([]byte, string, error) {
 	var req FindRequest
 	req.Hdr = newHdr(request)
 	req.Action = "find_node"
 	req.Data.ID = id
 	req.Data.Target = target
+	req.Data.Want = want
 	data, err := bencode.Encode(req)
 	if err != nil {
 		return nil, "", err
@@ -38,12 +41,13 @@ func FindReq(id, target [20]byte) ([]byte, string, error) {
 }
 
 // FindRep build find_node response packet
-func FindRep(tx string, id [20]byte, nodes string) ([]byte, error) {
+func FindRep(tx string, id [20]byte, nodes, nodes6 string) ([]byte, error) {
 	var rep FindResponse
 	rep.Transaction = tx
 	rep.Type = response
 	rep.Response.ID = id
 	rep.Response.Nodes = nodes
+	rep.Response.Nodes6 = nodes6
 	data, err := bencode.Encode(rep)
 	if err != nil {
 		return nil, err
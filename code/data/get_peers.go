@@ -9,6 +9,7 @@ type GetPeersRequest struct {
 	Data   struct {
 		ID   [20]byte `bencode:"id"`
 		Hash [20]byte `bencode:"info_hash"`
+		Want []string `bencode:"want"`
 	} `bencode:"a"`
 }
 
@@ -26,19 +27,21 @@ type GetPeersResponse struct {
 type GetPeersNotFoundResponse struct {
 	Hdr
 	Response struct {
-		ID    [20]byte `bencode:"id"`
-		Token string   `bencode:"token"`
-		Nodes string   `bencode:"nodes"`
+		ID     [20]byte `bencode:"id"`
+		Token  string   `bencode:"token"`
+		Nodes  string   `bencode:"nodes"`
+		Nodes6 string   `bencode:"nodes6"`
 	} `bencode:"r"`
 }
 
 // GetPeers build get_peers request packet
-func GetPeers(id, hash [20]byte) ([]byte, string, error) {
+func GetPeers(id, hash [20]byte, want []string) ([]byte, string, error) {
 	var req GetPeersRequest
 	req.Hdr = newHdr(request)
 	req.Action = "get_peers"
 	req.Data.ID = id
 	req.Data.Hash = hash
+	req.Data.Want = want
 	data, err := bencode.Encode(req)
 	if err != nil {
 		return nil, "", err
@@ -46,14 +49,30 @@ func GetPeers(id, hash [20]byte) ([]byte, string, error) {
 	return data, req.Hdr.Transaction, nil
 }
 
+// GetPeersFound build get_peers response packet with peers
+func GetPeersFound(tx string, id [20]byte, token string, values []string) ([]byte, error) {
+	var rep GetPeersResponse
+	rep.Transaction = tx
+	rep.Type = response
+	rep.Response.ID = id
+	rep.Response.Token = token
+	rep.Response.Values = values
+	data, err := bencode.Encode(rep)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
 // GetPeersNotFound build get_peers not found response packet
-func GetPeersNotFound(tx string, id [20]byte, token, nodes string) ([]byte, error) {
+func GetPeersNotFound(tx string, id [20]byte, token, nodes, nodes6 string) ([]byte, error) {
 	var rep GetPeersNotFoundResponse
 	rep.Transaction = tx
 	rep.Type = response
 	rep.Response.ID = id
 	rep.Response.Token = token
 	rep.Response.Nodes = nodes
+	rep.Response.Nodes6 = nodes6
 	data, err := bencode.Encode(rep)
 	if err != nil {
 		return nil, err
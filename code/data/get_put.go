@@ -0,0 +1,258 @@
+package data
+
+import (
+	"errors"
+)
+
+// http://www.bittorrent.org/beps/bep_0044.html
+// the get and put packets are encoded by RawDict, the value in v is kept raw
+
+var errInvalidPacket = errors.New("invalid packet")
+
+// GetRequest get request
+type GetRequest struct {
+	Transaction string
+	ID          [20]byte
+	Target      [20]byte
+	Seq         int64 // -1 when not set
+	Want        []string
+}
+
+// GetResponse get response
+type GetResponse struct {
+	ID     [20]byte
+	Token  string
+	Nodes  string
+	Nodes6 string
+	Item   *Item // nil when not found
+	Seq    int64 // -1 when not set
+}
+
+// PutRequest put request
+type PutRequest struct {
+	Transaction string
+	ID          [20]byte
+	Token       string
+	Item        Item
+	Cas         int64 // -1 when not set
+}
+
+func newReq(action ReqType, args RawDict) ([]byte, string) {
+	tx := Rand(16)
+	return RawDict{
+		"t": EncodeString(tx),
+		"y": EncodeString(request),
+		"q": EncodeString(string(action)),
+		"a": args.Encode(),
+	}.Encode(), tx
+}
+
+func newRep(tx string, r RawDict) []byte {
+	return RawDict{
+		"t": EncodeString(tx),
+		"y": EncodeString(response),
+		"r": r.Encode(),
+	}.Encode()
+}
+
+func encodeWant(want []string) []byte {
+	list := make([][]byte, len(want))
+	for i, w := range want {
+		list[i] = EncodeString(w)
+	}
+	return EncodeList(list...)
+}
+
+// GetReq build get request packet, seq < 0 means not set
+func GetReq(id, target [20]byte, seq int64, want []string) ([]byte, string, error) {
+	args := RawDict{
+		"id":     EncodeString(string(id[:])),
+		"target": EncodeString(string(target[:])),
+		"want":   encodeWant(want),
+	}
+	if seq >= 0 {
+		args["seq"] = EncodeInt(seq)
+	}
+	data, tx := newReq(TypeGet, args)
+	return data, tx, nil
+}
+
+// GetRep build get response packet, item is nil when not found,
+// v is omitted when the seq of item is not greater than seq
+func GetRep(tx string, id [20]byte, token, nodes, nodes6 string, item *Item, seq int64) ([]byte, error) {
+	r := RawDict{
+		"id":     EncodeString(string(id[:])),
+		"token":  EncodeString(token),
+		"nodes":  EncodeString(nodes),
+		"nodes6": EncodeString(nodes6),
+	}
+	if item != nil {
+		if item.Mutable() {
+			r["k"] = EncodeString(string(item.K[:]))
+			r["seq"] = EncodeInt(item.Seq)
+			if seq < 0 || item.Seq > seq {
+				r["sig"] = EncodeString(string(item.Sig[:]))
+				r["v"] = item.V
+			}
+		} else {
+			r["v"] = item.V
+		}
+	}
+	return newRep(tx, r), nil
+}
+
+// PutReq build put request packet, cas < 0 means not set
+func PutReq(id [20]byte, token string, item Item, cas int64) ([]byte, string, error) {
+	err := item.check()
+	if err != nil {
+		return nil, "", err
+	}
+	args := RawDict{
+		"id":    EncodeString(string(id[:])),
+		"token": EncodeString(token),
+		"v":     item.V,
+	}
+	if item.Mutable() {
+		args["k"] = EncodeString(string(item.K[:]))
+		args["sig"] = EncodeString(string(item.Sig[:]))
+		args["seq"] = EncodeInt(item.Seq)
+		if len(item.Salt) > 0 {
+			args["salt"] = EncodeString(string(item.Salt))
+		}
+		if cas >= 0 {
+			args["cas"] = EncodeInt(cas)
+		}
+	}
+	data, tx := newReq(TypePut, args)
+	return data, tx, nil
+}
+
+// PutRep build put response packet
+func PutRep(tx string, id [20]byte) ([]byte, error) {
+	return newRep(tx, RawDict{
+		"id": EncodeString(string(id[:])),
+	}), nil
+}
+
+func dictOf(v interface{}, key string) map[string]interface{} {
+	dict, _ := v.(map[string]interface{})
+	if dict == nil {
+		return nil
+	}
+	ret, _ := dict[key].(map[string]interface{})
+	return ret
+}
+
+func copyString(dst []byte, dict map[string]interface{}, key string) bool {
+	str, ok := dict[key].(string)
+	if !ok || len(str) != len(dst) {
+		return false
+	}
+	copy(dst, str)
+	return true
+}
+
+func intOf(dict map[string]interface{}, key string) int64 {
+	n, ok := dict[key].(int64)
+	if !ok {
+		return -1
+	}
+	return n
+}
+
+// ParseGetReq parse get request packet
+func ParseGetReq(buf []byte) (GetRequest, error) {
+	var req GetRequest
+	v, err := Decode(buf)
+	if err != nil {
+		return req, err
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return req, errInvalidPacket
+	}
+	req.Transaction, _ = dict["t"].(string)
+	args := dictOf(v, "a")
+	if !copyString(req.ID[:], args, "id") ||
+		!copyString(req.Target[:], args, "target") {
+		return req, errInvalidPacket
+	}
+	req.Seq = intOf(args, "seq")
+	want, _ := args["want"].([]interface{})
+	for _, w := range want {
+		if str, ok := w.(string); ok {
+			req.Want = append(req.Want, str)
+		}
+	}
+	return req, nil
+}
+
+// ParseGetRep parse get response packet
+func ParseGetRep(buf []byte) (GetResponse, error) {
+	var rep GetResponse
+	v, err := Decode(buf)
+	if err != nil {
+		return rep, err
+	}
+	r := dictOf(v, "r")
+	if !copyString(rep.ID[:], r, "id") {
+		return rep, errInvalidPacket
+	}
+	rep.Token, _ = r["token"].(string)
+	rep.Nodes, _ = r["nodes"].(string)
+	rep.Nodes6, _ = r["nodes6"].(string)
+	rep.Seq = intOf(r, "seq")
+	raw, err := RawValue(buf, "r", "v")
+	if err != nil || raw == nil {
+		return rep, err
+	}
+	item := Item{V: raw}
+	if _, ok := r["k"]; ok {
+		item.Seq = rep.Seq
+		if !copyString(item.K[:], r, "k") ||
+			!copyString(item.Sig[:], r, "sig") ||
+			item.Seq < 0 {
+			return rep, errInvalidPacket
+		}
+	}
+	rep.Item = &item
+	return rep, nil
+}
+
+// ParsePutReq parse put request packet
+func ParsePutReq(buf []byte) (PutRequest, error) {
+	var req PutRequest
+	v, err := Decode(buf)
+	if err != nil {
+		return req, err
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return req, errInvalidPacket
+	}
+	req.Transaction, _ = dict["t"].(string)
+	args := dictOf(v, "a")
+	if !copyString(req.ID[:], args, "id") {
+		return req, errInvalidPacket
+	}
+	req.Token, _ = args["token"].(string)
+	req.Cas = intOf(args, "cas")
+	raw, err := RawValue(buf, "a", "v")
+	if err != nil {
+		return req, err
+	}
+	if raw == nil {
+		return req, errInvalidPacket
+	}
+	req.Item.V = raw
+	if _, ok := args["k"]; ok {
+		if !copyString(req.Item.K[:], args, "k") ||
+			!copyString(req.Item.Sig[:], args, "sig") {
+			return req, errInvalidPacket
+		}
+		req.Item.Seq = intOf(args, "seq")
+		salt, _ := args["salt"].(string)
+		req.Item.Salt = []byte(salt)
+	}
+	return req, nil
+}
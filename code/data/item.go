@@ -0,0 +1,96 @@
+package data
+
+import (
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"strconv"
+)
+
+// http://www.bittorrent.org/beps/bep_0044.html
+const (
+	// MaxItemSize max size of v
+	MaxItemSize = 1000
+	// MaxSaltSize max size of salt
+	MaxSaltSize = 64
+)
+
+// Item immutable or mutable item
+type Item struct {
+	V    []byte   // bencoded value
+	K    [32]byte // ed25519 public key, empty for immutable item
+	Sig  [64]byte // ed25519 signature
+	Seq  int64
+	Salt []byte
+}
+
+// NewImmutableItem create immutable item by bencoded value
+func NewImmutableItem(v []byte) (Item, error) {
+	item := Item{V: v}
+	return item, item.check()
+}
+
+// NewMutableItem create mutable item by bencoded value and sign it
+func NewMutableItem(key ed25519.PrivateKey, v []byte, seq int64, salt []byte) (Item, error) {
+	item := Item{
+		V:    v,
+		Seq:  seq,
+		Salt: salt,
+	}
+	copy(item.K[:], key.Public().(ed25519.PublicKey))
+	copy(item.Sig[:], ed25519.Sign(key, item.signData()))
+	return item, item.check()
+}
+
+// Mutable is mutable item
+func (item Item) Mutable() bool {
+	var empty [32]byte
+	return item.K != empty
+}
+
+// Target get target of item
+func (item Item) Target() [20]byte {
+	if item.Mutable() {
+		return MutableTarget(item.K, item.Salt)
+	}
+	return ImmutableTarget(item.V)
+}
+
+// ImmutableTarget target of immutable item
+func ImmutableTarget(v []byte) [20]byte {
+	return sha1.Sum(v)
+}
+
+// MutableTarget target of mutable item
+func MutableTarget(k [32]byte, salt []byte) [20]byte {
+	return sha1.Sum(append(k[:], salt...))
+}
+
+func (item Item) signData() []byte {
+	var ret []byte
+	if len(item.Salt) > 0 {
+		ret = append(ret, "4:salt"...)
+		ret = append(ret, EncodeString(string(item.Salt))...)
+	}
+	ret = append(ret, "3:seqi"+strconv.FormatInt(item.Seq, 10)+"e1:v"...)
+	return append(ret, item.V...)
+}
+
+// Verify verify signature of mutable item
+func (item Item) Verify() bool {
+	if !item.Mutable() {
+		return true
+	}
+	return ed25519.Verify(item.K[:], item.signData(), item.Sig[:])
+}
+
+func (item Item) check() error {
+	if len(item.V) > MaxItemSize {
+		return errors.New("v is too big")
+	}
+	if len(item.Salt) > MaxSaltSize {
+		return errors.New("salt is too big")
+	}
+	_, err := Decode(item.V)
+	return err
+}
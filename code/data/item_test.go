@@ -0,0 +1,116 @@
+package data
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// http://www.bittorrent.org/beps/bep_0044.html#test-vectors
+func TestMutableItem(t *testing.T) {
+	k, _ := hex.DecodeString("77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548")
+	cases := []struct {
+		salt   string
+		sig    string
+		target string
+	}{
+		{"", "305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff" +
+			"1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01",
+			"4a533d47ec9c7d95b1ad75f576cffc641853b750"},
+		{"foobar", "6834284b6b24c3204eb2fea824d82f88883a3d95e8b4a21b8c0ded553d17d17d" +
+			"df9a8a7104b1258f30bed3787e6cb896fca78c58f8e03b5f18f14951a87d9a08",
+			"411eba73b6f087ca51a3795d9c8c938d365e32c1"},
+	}
+	for _, c := range cases {
+		item := Item{V: []byte("12:Hello World!"), Seq: 1, Salt: []byte(c.salt)}
+		copy(item.K[:], k)
+		sig, _ := hex.DecodeString(c.sig)
+		copy(item.Sig[:], sig)
+		if !item.Verify() {
+			t.Errorf("verify failed, salt=%q", c.salt)
+		}
+		target := item.Target()
+		if hex.EncodeToString(target[:]) != c.target {
+			t.Errorf("unexpected target %x, salt=%q", target, c.salt)
+		}
+		item.Seq = 2
+		if item.Verify() {
+			t.Errorf("verify should fail with wrong seq, salt=%q", c.salt)
+		}
+	}
+}
+
+func TestGetPutPacket(t *testing.T) {
+	var id, target [20]byte
+	item, err := NewImmutableItem([]byte("ll1:aee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _, err := PutReq(id, "token", item, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := ParsePutReq(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(req.Item.V) != "ll1:aee" || req.Token != "token" || req.Cas != -1 {
+		t.Fatalf("unexpected put request: %+v", req)
+	}
+	buf, err = GetRep("tx", id, "token", "", "", &item, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := ParseGetRep(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Item == nil || string(rep.Item.V) != "ll1:aee" {
+		t.Fatalf("unexpected get response: %+v", rep)
+	}
+	target = rep.Item.Target()
+	if target != item.Target() {
+		t.Fatal("unexpected target")
+	}
+}
+
+func TestInvalidPacket(t *testing.T) {
+	for _, buf := range []string{"i1e", "l1:ae", "4:spam"} {
+		if _, err := ParsePacket([]byte(buf)); err != errInvalidPacket {
+			t.Fatalf("unexpected error of %s: %v", buf, err)
+		}
+		if _, err := ParseGetReq([]byte(buf)); err != errInvalidPacket {
+			t.Fatalf("unexpected error of %s: %v", buf, err)
+		}
+		if _, err := ParsePutReq([]byte(buf)); err != errInvalidPacket {
+			t.Fatalf("unexpected error of %s: %v", buf, err)
+		}
+	}
+	var id [20]byte
+	id[0] = 1
+	buf, tx, err := GetReq(id, id, -1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := ParsePacket(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pkt.IsRequest() || pkt.Transaction != tx || pkt.ID != id || pkt.Query != TypeGet {
+		t.Fatalf("unexpected packet: %+v", pkt)
+	}
+}
+
+func TestDecodeDepth(t *testing.T) {
+	deep := strings.Repeat("l", 1<<20) + strings.Repeat("e", 1<<20)
+	if _, err := Decode([]byte(deep)); err != errInvalidBencode {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := RawValue([]byte("d1:v"+deep+"e"), "v"); err != errInvalidBencode {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ok := strings.Repeat("l", maxDepth) + strings.Repeat("e", maxDepth)
+	if _, err := Decode([]byte(ok)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,174 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// the bencode library can not keep raw value and not support list in list,
+// so raw values such as bep_0044 "v" and info dictionary are parsed here
+
+var errInvalidBencode = errors.New("invalid bencode data")
+
+// maxDepth max nesting depth of list and dictionary, avoid stack overflow by peer data
+const maxDepth = 64
+
+// Decode decode bencode data to int64, string, []interface{} or map[string]interface{}
+func Decode(buf []byte) (interface{}, error) {
+	v, end, err := decodeAt(buf, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if end != len(buf) {
+		return nil, fmt.Errorf("unexpected data after offset %d", end)
+	}
+	return v, nil
+}
+
+func decodeAt(buf []byte, pos, depth int) (interface{}, int, error) {
+	if pos >= len(buf) || depth > maxDepth {
+		return nil, pos, errInvalidBencode
+	}
+	switch ch := buf[pos]; {
+	case ch == 'i':
+		end := bytes.IndexByte(buf[pos:], 'e')
+		if end < 0 {
+			return nil, pos, errInvalidBencode
+		}
+		n, err := strconv.ParseInt(string(buf[pos+1:pos+end]), 10, 64)
+		if err != nil {
+			return nil, pos, err
+		}
+		return n, pos + end + 1, nil
+	case ch == 'l':
+		list := []interface{}{}
+		pos++
+		for pos < len(buf) && buf[pos] != 'e' {
+			var v interface{}
+			var err error
+			v, pos, err = decodeAt(buf, pos, depth+1)
+			if err != nil {
+				return nil, pos, err
+			}
+			list = append(list, v)
+		}
+		if pos >= len(buf) {
+			return nil, pos, errInvalidBencode
+		}
+		return list, pos + 1, nil
+	case ch == 'd':
+		dict := make(map[string]interface{})
+		pos++
+		for pos < len(buf) && buf[pos] != 'e' {
+			k, next, err := decodeAt(buf, pos, depth+1)
+			if err != nil {
+				return nil, pos, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, pos, errInvalidBencode
+			}
+			dict[key], pos, err = decodeAt(buf, next, depth+1)
+			if err != nil {
+				return nil, pos, err
+			}
+		}
+		if pos >= len(buf) {
+			return nil, pos, errInvalidBencode
+		}
+		return dict, pos + 1, nil
+	case ch >= '0' && ch <= '9':
+		colon := bytes.IndexByte(buf[pos:], ':')
+		if colon < 0 {
+			return nil, pos, errInvalidBencode
+		}
+		size, err := strconv.Atoi(string(buf[pos : pos+colon]))
+		if err != nil {
+			return nil, pos, err
+		}
+		start := pos + colon + 1
+		if size < 0 || start+size > len(buf) {
+			return nil, pos, errInvalidBencode
+		}
+		return string(buf[start : start+size]), start + size, nil
+	default:
+		return nil, pos, errInvalidBencode
+	}
+}
+
+// RawValue get raw bencode data of value in dictionary by keys path,
+// returns nil when not found
+func RawValue(buf []byte, keys ...string) ([]byte, error) {
+	pos := 0
+	for _, key := range keys {
+		if pos >= len(buf) || buf[pos] != 'd' {
+			return nil, errInvalidBencode
+		}
+		pos++
+		found := false
+		for pos < len(buf) && buf[pos] != 'e' {
+			k, next, err := decodeAt(buf, pos, 0)
+			if err != nil {
+				return nil, err
+			}
+			_, end, err := decodeAt(buf, next, 0)
+			if err != nil {
+				return nil, err
+			}
+			if k == key {
+				pos = next
+				found = true
+				break
+			}
+			pos = end
+		}
+		if !found {
+			return nil, nil
+		}
+	}
+	_, end, err := decodeAt(buf, pos, 0)
+	if err != nil {
+		return nil, err
+	}
+	return buf[pos:end], nil
+}
+
+// EncodeString encode string
+func EncodeString(str string) []byte {
+	return []byte(strconv.Itoa(len(str)) + ":" + str)
+}
+
+// EncodeInt encode integer
+func EncodeInt(n int64) []byte {
+	return []byte("i" + strconv.FormatInt(n, 10) + "e")
+}
+
+// EncodeList encode list of encoded values
+func EncodeList(values ...[]byte) []byte {
+	ret := []byte{'l'}
+	for _, v := range values {
+		ret = append(ret, v...)
+	}
+	return append(ret, 'e')
+}
+
+// RawDict dictionary of encoded values
+type RawDict map[string][]byte
+
+// Encode encode dictionary in sorted keys
+func (d RawDict) Encode() []byte {
+	keys := make([]string, 0, len(d))
+	for k := range d {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ret := []byte{'d'}
+	for _, k := range keys {
+		ret = append(ret, EncodeString(k)...)
+		ret = append(ret, d[k]...)
+	}
+	return append(ret, 'e')
+}
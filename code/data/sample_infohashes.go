@@ -0,0 +1,61 @@
+package data
+
+import "github.com/lwch/bencode"
+
+// SampleInfohashesRequest sample_infohashes request
+// http://www.bittorrent.org/beps/bep_0051.html
+type SampleInfohashesRequest struct {
+	Hdr
+	Action string `bencode:"q"`
+	Data   struct {
+		ID     [20]byte `bencode:"id"`
+		Target [20]byte `bencode:"target"`
+		Want   []string `bencode:"want"`
+	} `bencode:"a"`
+}
+
+// SampleInfohashesResponse sample_infohashes response
+type SampleInfohashesResponse struct {
+	Hdr
+	Response struct {
+		ID       [20]byte `bencode:"id"`
+		Interval int      `bencode:"interval"`
+		Nodes    string   `bencode:"nodes"`
+		Nodes6   string   `bencode:"nodes6"`
+		Num      int      `bencode:"num"`
+		Samples  string   `bencode:"samples"`
+	} `bencode:"r"`
+}
+
+// SampleInfohashesReq build sample_infohashes request packet
+func SampleInfohashesReq(id, target [20]byte, want []string) ([]byte, string, error) {
+	var req SampleInfohashesRequest
+	req.Hdr = newHdr(request)
+	req.Action = string(TypeSampleInfohashes)
+	req.Data.ID = id
+	req.Data.Target = target
+	req.Data.Want = want
+	data, err := bencode.Encode(req)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, req.Hdr.Transaction, nil
+}
+
+// SampleInfohashesRep build sample_infohashes response packet
+func SampleInfohashesRep(tx string, id [20]byte, interval, num int, samples, nodes, nodes6 string) ([]byte, error) {
+	var rep SampleInfohashesResponse
+	rep.Transaction = tx
+	rep.Type = response
+	rep.Response.ID = id
+	rep.Response.Interval = interval
+	rep.Response.Nodes = nodes
+	rep.Response.Nodes6 = nodes6
+	rep.Response.Num = num
+	rep.Response.Samples = samples
+	data, err := bencode.Encode(rep)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,121 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lwch/magic/code/data"
+	"github.com/lwch/magic/code/logging"
+)
+
+var errNoToken = errors.New("no node responded with token")
+
+// Announce announce peer of info_hash to the closest nodes,
+// returns the count of nodes announced
+// http://www.bittorrent.org/beps/bep_0005.html#announce-peer
+func (dht *DHT) Announce(ctx context.Context, hash [20]byte, port uint16, impliedPort bool) (int, error) {
+	lk, err := dht.newLookup(data.TypeGetPeers, hash)
+	if err != nil {
+		return 0, err
+	}
+	// announce to the responded nodes even if the lookup is not finished
+	lk.run(ctx)
+	cnt := 0
+	for _, n := range lk.nodes {
+		if cnt >= neighborSize {
+			break
+		}
+		if n.state != lookupResponded || len(n.token) == 0 {
+			continue
+		}
+		buf, tx, err := data.AnnouncePeerReq(dht.localID(), hash, port, impliedPort, n.token)
+		if err != nil {
+			logging.Error("build announce_peer packet failed, addr=%s, err=%v", n.addr.String(), err)
+			continue
+		}
+		err = dht.send(buf, &n.addr)
+		if err != nil {
+			logging.Error("send announce_peer packet failed, addr=%s, err=%v", n.addr.String(), err)
+			continue
+		}
+		dht.tx.add(tx, data.TypeAnnouncePeer, hash, n.id)
+		cnt++
+	}
+	if cnt == 0 {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, errNoToken
+	}
+	return cnt, nil
+}
+
+type announceItem struct {
+	port    uint16
+	implied bool
+	next    time.Time
+}
+
+// announcer re-announce info_hash on schedule
+type announcer struct {
+	sync.Mutex
+	dht      *DHT
+	items    map[hashType]*announceItem
+	interval time.Duration
+}
+
+func newAnnouncer(dht *DHT, interval time.Duration) *announcer {
+	return &announcer{
+		dht:      dht,
+		items:    make(map[hashType]*announceItem),
+		interval: interval,
+	}
+}
+
+// StartAnnounce announce info_hash now and re-announce it on schedule
+func (dht *DHT) StartAnnounce(hash [20]byte, port uint16, impliedPort bool) {
+	dht.announce.Lock()
+	dht.announce.items[hash] = &announceItem{
+		port:    port,
+		implied: impliedPort,
+	}
+	dht.announce.Unlock()
+	go dht.announce.check()
+}
+
+// StopAnnounce stop re-announce info_hash
+func (dht *DHT) StopAnnounce(hash [20]byte) {
+	dht.announce.Lock()
+	delete(dht.announce.items, hash)
+	dht.announce.Unlock()
+}
+
+func (a *announcer) check() {
+	now := time.Now()
+	a.Lock()
+	var hashes []hashType
+	var items []announceItem
+	for hash, item := range a.items {
+		if now.Before(item.next) {
+			continue
+		}
+		item.next = now.Add(a.interval)
+		hashes = append(hashes, hash)
+		items = append(items, *item)
+	}
+	a.Unlock()
+	for i, hash := range hashes {
+		go func(hash hashType, item announceItem) {
+			ctx, cancel := context.WithTimeout(a.dht.ctx, time.Minute)
+			defer cancel()
+			cnt, err := a.dht.Announce(ctx, hash, item.port, item.implied)
+			if err != nil {
+				logging.Info("announce %s failed: %v", hash.String(), err)
+				return
+			}
+			logging.Info("announce %s to %d nodes", hash.String(), cnt)
+		}(hash, items[i])
+	}
+}
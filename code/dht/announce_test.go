@@ -0,0 +1,175 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lwch/bencode"
+	"github.com/lwch/magic/code/data"
+)
+
+// fakeNode responds get_peers with token and nodes, responds get with item,
+// and reports announce_peer
+type fakeNode struct {
+	conn      net.PacketConn
+	id        hashType
+	nodes     string
+	item      *data.Item
+	announced chan data.AnnouncePeerRequest
+}
+
+func newFakeNode(t *testing.T, nodes string, item *data.Item) *fakeNode {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &fakeNode{
+		conn:      conn,
+		id:        hashType(data.RandID()),
+		nodes:     nodes,
+		item:      item,
+		announced: make(chan data.AnnouncePeerRequest, 10),
+	}
+	go n.serve()
+	return n
+}
+
+func (n *fakeNode) addr() *net.UDPAddr {
+	return n.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (n *fakeNode) serve() {
+	buf := make([]byte, 65535)
+	for {
+		l, addr, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		pkt, err := data.ParsePacket(buf[:l])
+		if err != nil {
+			continue
+		}
+		switch pkt.Query {
+		case data.TypeGetPeers:
+			rep, _ := data.GetPeersNotFound(pkt.Transaction, n.id, "tk", n.nodes, "")
+			n.conn.WriteTo(rep, addr)
+		case data.TypeGet:
+			rep, _ := data.GetRep(pkt.Transaction, n.id, "tk", n.nodes, "", n.item, -1)
+			n.conn.WriteTo(rep, addr)
+		case data.TypeAnnouncePeer:
+			var req data.AnnouncePeerRequest
+			if bencode.Decode(buf[:l], &req) == nil {
+				n.announced <- req
+			}
+		}
+	}
+}
+
+// newAnnounceDHT dht with nodes only in routing table
+func newAnnounceDHT(t *testing.T, port uint16, nodes ...*net.UDPAddr) *DHT {
+	cfg := NewConfig()
+	cfg.Listen = port
+	cfg.DisableIPv6 = true
+	dht, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range nodes {
+		dht.tb.add(newNode(dht, data.RandID(), *addr))
+	}
+	return dht
+}
+
+func waitAnnounced(t *testing.T, n *fakeNode, hash hashType, port uint16) {
+	select {
+	case req := <-n.announced:
+		if req.Data.Hash != hash || req.Data.Port != port || req.Data.Token != "tk" {
+			t.Fatalf("unexpected announce_peer: %+v", req.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("announce_peer not received")
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	n := newFakeNode(t, "", nil)
+	defer n.conn.Close()
+	dht := newAnnounceDHT(t, 16894, n.addr())
+	defer dht.Close()
+	hash := hashType(data.RandID())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cnt, err := dht.Announce(ctx, hash, 6881, false)
+	if err != nil || cnt != 1 {
+		t.Fatalf("announce to %d nodes: %v", cnt, err)
+	}
+	waitAnnounced(t, n, hash, 6881)
+}
+
+func TestAnnounceTimeout(t *testing.T) {
+	hash := hashType(data.RandID())
+	// closer nodes never respond, so the lookup is not finished
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	addr := silent.LocalAddr().(*net.UDPAddr)
+	id := hash
+	id[19] ^= 1
+	nodes := string(id[:]) + string(addr.IP.To4()) + string([]byte{byte(addr.Port >> 8), byte(addr.Port)})
+	n := newFakeNode(t, nodes, nil)
+	defer n.conn.Close()
+	dht := newAnnounceDHT(t, 16895, n.addr())
+	defer dht.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	cnt, err := dht.Announce(ctx, hash, 6881, false)
+	if err != nil || cnt != 1 {
+		t.Fatalf("announce to %d nodes: %v", cnt, err)
+	}
+	waitAnnounced(t, n, hash, 6881)
+
+	// no token collected
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	lonely := newAnnounceDHT(t, 16896, addr)
+	defer lonely.Close()
+	_, err = lonely.Announce(ctx, hash, 6881, false)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestStartAnnounce(t *testing.T) {
+	n := newFakeNode(t, "", nil)
+	defer n.conn.Close()
+	dht := newAnnounceDHT(t, 16897, n.addr())
+	defer dht.Close()
+	hash := hashType(data.RandID())
+	dht.StartAnnounce(hash, 6881, false)
+	waitAnnounced(t, n, hash, 6881)
+
+	// not announced again before interval
+	dht.announce.check()
+	select {
+	case <-n.announced:
+		t.Fatal("announced before interval")
+	case <-time.After(time.Second):
+	}
+	dht.announce.Lock()
+	dht.announce.items[hash].next = time.Now()
+	dht.announce.Unlock()
+	dht.announce.check()
+	waitAnnounced(t, n, hash, 6881)
+
+	dht.StopAnnounce(hash)
+	dht.announce.Lock()
+	left := len(dht.announce.items)
+	dht.announce.Unlock()
+	if left != 0 {
+		t.Fatal("info_hash is not removed from announcer")
+	}
+}
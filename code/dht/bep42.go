@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"crypto/rand"
+	"hash/crc32"
+	"net"
+	"sync"
+)
+
+// http://www.bittorrent.org/beps/bep_0042.html
+var v4Mask = []byte{0x03, 0x0f, 0x3f, 0xff}
+var v6Mask = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+const ipVoteThreshold = 10
+
+func secureCRC(ip net.IP, r byte) (uint32, bool) {
+	var mask []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		mask = v4Mask
+	} else if ip6 := ip.To16(); ip6 != nil {
+		ip = ip6
+		mask = v6Mask
+	} else {
+		return 0, false
+	}
+	buf := make([]byte, len(mask))
+	for i := range mask {
+		buf[i] = ip[i] & mask[i]
+	}
+	buf[0] |= (r & 0x7) << 5
+	return crc32.Checksum(buf, crc32c), true
+}
+
+// secureID generate node id from external ip
+func secureID(ip net.IP) hashType {
+	var id hashType
+	rand.Read(id[:])
+	crc, ok := secureCRC(ip, id[19])
+	if !ok {
+		return id
+	}
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x7
+	return id
+}
+
+// checkSecureID check node id is generated from ip, local network ip is always valid
+func checkSecureID(ip net.IP, id hashType) bool {
+	if isLocalIP(ip) {
+		return true
+	}
+	crc, ok := secureCRC(ip, id[19])
+	if !ok {
+		return false
+	}
+	return id[0] == byte(crc>>24) &&
+		id[1] == byte(crc>>16) &&
+		id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+var localNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"169.254.0.0/16",
+		"127.0.0.0/8",
+		"fc00::/7",
+		"fe80::/10",
+		"::1/128",
+	} {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		localNets = append(localNets, ipNet)
+	}
+}
+
+func isLocalIP(ip net.IP) bool {
+	for _, ipNet := range localNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipVoter vote external ip by the ip field in response or yourip in extended handshake,
+// every voter votes only once
+type ipVoter struct {
+	sync.Mutex
+	voters map[string]bool
+	votes  map[string]int
+}
+
+func newIPVoter() *ipVoter {
+	return &ipVoter{
+		voters: make(map[string]bool),
+		votes:  make(map[string]int),
+	}
+}
+
+// vote returns the external ip when votes reached threshold
+func (v *ipVoter) vote(voter, ip net.IP) net.IP {
+	if ip == nil || isLocalIP(ip) {
+		return nil
+	}
+	v.Lock()
+	defer v.Unlock()
+	if v.voters[voter.String()] {
+		return nil
+	}
+	v.voters[voter.String()] = true
+	v.votes[ip.String()]++
+	if v.votes[ip.String()] < ipVoteThreshold {
+		return nil
+	}
+	v.voters = make(map[string]bool)
+	v.votes = make(map[string]int)
+	return ip
+}
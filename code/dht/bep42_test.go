@@ -0,0 +1,36 @@
+package dht
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// http://www.bittorrent.org/beps/bep_0042.html#test-vectors
+func TestSecureID(t *testing.T) {
+	for _, c := range []struct {
+		ip string
+		id string
+	}{
+		{"124.31.75.21", "5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eee401"},
+		{"21.75.31.124", "5a3ce9c14e7a08645677bbd1cfe7d8f956d53256"},
+		{"65.23.51.170", "a5d43220bc8f112a3d426c84764f8c2a1150e616"},
+		{"84.124.73.14", "1b0321dd1bb1fe518101ceef99462b947a01ff41"},
+		{"43.213.53.83", "e56f6cbf5b7c4be0237986d5243b87aa6d51305a"},
+	} {
+		var id hashType
+		raw, _ := hex.DecodeString(c.id)
+		copy(id[:], raw)
+		if !checkSecureID(net.ParseIP(c.ip), id) {
+			t.Fatalf("check secure id failed: ip=%s, id=%s", c.ip, c.id)
+		}
+		id[0]++
+		if checkSecureID(net.ParseIP(c.ip), id) {
+			t.Fatalf("check invalid id success: ip=%s", c.ip)
+		}
+	}
+	ip := net.ParseIP("2001:db8::1")
+	if !checkSecureID(ip, secureID(ip)) {
+		t.Fatal("check generated ipv6 id failed")
+	}
+}
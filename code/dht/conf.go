@@ -3,16 +3,88 @@ package dht
 import (
 	"net"
 	"time"
+
+	"github.com/lwch/magic/code/mse"
+)
+
+// DropPolicy policy of metadata fetch queue when it is full
+type DropPolicy int
+
+const (
+	// DropNewest skip the new request
+	DropNewest DropPolicy = iota
+	// DropOldest drop the oldest request in queue
+	DropOldest
+	// DropLowest drop the request with lowest priority
+	DropLowest
+)
+
+// Transport transport of connecting peer for metadata fetching
+// http://www.bittorrent.org/beps/bep_0029.html
+type Transport int
+
+const (
+	// TransportParallel dial by tcp and utp at the same time, the first handshaked is used
+	TransportParallel Transport = iota
+	// TransportTCPFirst dial by utp when tcp is failed
+	TransportTCPFirst
+	// TransportUTPFirst dial by tcp when utp is failed
+	TransportUTPFirst
+	// TransportTCP tcp only
+	TransportTCP
+	// TransportUTP utp only
+	TransportUTP
 )
 
+// PriorityWeights weights of metadata fetch priority, the info_hash with
+// higher priority is fetched first
+type PriorityWeights struct {
+	Announce float64 // each announce_peer
+	IP       float64 // each distinct announcing ip
+	Query    float64 // each get_peers query
+	Age      float64 // each minute since first seen
+}
+
 // Config dht config
 type Config struct {
-	Listen     uint16                      // Default: 6881
-	MinNodes   int                         // Default: 10000
-	MaxNodes   int                         // Default: 1000000
-	TxTimeout  time.Duration               // Default: 30s
-	GenID      func() [20]byte             // generate find id
-	NodeFilter func(net.IP, [20]byte) bool // filter func for node id
+	Listen           uint16                      // Default: 6881
+	DisableIPv6      bool                        // do not listen on ipv6
+	MinNodes         int                         // Default: 10000
+	MaxNodes         int                         // Default: 1000000
+	TxTimeout        time.Duration               // Default: 30s
+	GenID            func() [20]byte             // generate find id
+	NodeFilter       func(net.IP, [20]byte) bool // filter func for node id
+	PeerTimeout      time.Duration               // announced peer expire time, Default: 30m
+	MaxPeersPerHash  int                         // Default: 100
+	MaxPeerHashes    int                         // Default: 100000
+	ReAnnounce       time.Duration               // interval of re-announce, Default: 15m
+	NodesFile        string                      // save routing table to file, empty to disable
+	NodesReadOnly    bool                        // restore from NodesFile but never save to it
+	SaveInterval     time.Duration               // interval of save routing table, Default: 5m
+	MaxSaveNodes     int                         // Default: 10000
+	NodeID           [20]byte                    // local node id, load from IDFile or random when empty
+	IDFile           string                      // save local node id to file, empty to disable
+	SecureID         bool                        // derive node id from external ip, bep_0042
+	EnforceSecureID  bool                        // drop nodes which id is not match the ip, bep_0042
+	Sample           bool                        // crawl info_hash by sample_infohashes, bep_0051
+	StrictTable      bool                        // bep_0005 routing table, only the bucket containing local id is split
+	FetchTimeout     time.Duration               // deadline of fetching metadata of each info_hash, Default: 1m
+	FetchConcurrency int                         // max peers connected for each info_hash, Default: 3
+	FetchWorkers     int                         // max info_hash fetching at the same time, Default: 100
+	FetchQueue       int                         // size of fetch queue, Default: 1000
+	FetchDrop        DropPolicy                  // policy when fetch queue is full, Default: DropNewest
+	FetchPriority    PriorityWeights             // Default: {Announce: 1, IP: 2, Query: 0.5, Age: 1}
+	FetchTransport   Transport                   // Default: TransportParallel
+	FetchEncryption  mse.Policy                  // message stream encryption of peer connection, Default: mse.PolicyPlaintext
+	DropPadFiles     bool                        // drop padding files in MetaInfo, bep_0047
+	SeenWindow       time.Duration               // skip info_hash fetched in window, Default: 1h
+	MaxSeen          int                         // max info_hash in seen set, Default: 100000
+	ShouldFetch      func([20]byte) bool         // skip info_hash when returns false, such as it is already saved
+	FailBackoff      time.Duration               // first backoff of failed info_hash, doubled by each attempt, Default: 5m
+	MaxFailBackoff   time.Duration               // Default: 24h
+	MaxFailed        int                         // max info_hash in failed cache, Default: 100000
+	MaxItems         int                         // max stored bep_0044 items, Default: 10000
+	ItemTimeout      time.Duration               // stored bep_0044 item expire time, Default: 2h
 }
 
 // NewConfig create default config
@@ -35,4 +107,63 @@ func (cfg *Config) checkDefault() {
 	if cfg.TxTimeout <= 0 {
 		cfg.TxTimeout = 30 * time.Second
 	}
+	if cfg.PeerTimeout <= 0 {
+		cfg.PeerTimeout = 30 * time.Minute
+	}
+	if cfg.MaxPeersPerHash <= 0 {
+		cfg.MaxPeersPerHash = 100
+	}
+	if cfg.MaxPeerHashes <= 0 {
+		cfg.MaxPeerHashes = 100000
+	}
+	if cfg.ReAnnounce <= 0 {
+		cfg.ReAnnounce = 15 * time.Minute
+	}
+	if cfg.SaveInterval <= 0 {
+		cfg.SaveInterval = 5 * time.Minute
+	}
+	if cfg.MaxSaveNodes <= 0 {
+		cfg.MaxSaveNodes = 10000
+	}
+	if cfg.FetchTimeout <= 0 {
+		cfg.FetchTimeout = time.Minute
+	}
+	if cfg.FetchConcurrency <= 0 {
+		cfg.FetchConcurrency = 3
+	}
+	if cfg.FetchWorkers <= 0 {
+		cfg.FetchWorkers = 100
+	}
+	if cfg.FetchQueue <= 0 {
+		cfg.FetchQueue = 1000
+	}
+	if cfg.FetchPriority == (PriorityWeights{}) {
+		cfg.FetchPriority = PriorityWeights{
+			Announce: 1,
+			IP:       2,
+			Query:    0.5,
+			Age:      1,
+		}
+	}
+	if cfg.SeenWindow <= 0 {
+		cfg.SeenWindow = time.Hour
+	}
+	if cfg.MaxSeen <= 0 {
+		cfg.MaxSeen = 100000
+	}
+	if cfg.FailBackoff <= 0 {
+		cfg.FailBackoff = 5 * time.Minute
+	}
+	if cfg.MaxFailBackoff <= 0 {
+		cfg.MaxFailBackoff = 24 * time.Hour
+	}
+	if cfg.MaxFailed <= 0 {
+		cfg.MaxFailed = 100000
+	}
+	if cfg.MaxItems <= 0 {
+		cfg.MaxItems = 10000
+	}
+	if cfg.ItemTimeout <= 0 {
+		cfg.ItemTimeout = 2 * time.Hour
+	}
 }
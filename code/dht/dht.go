@@ -3,6 +3,7 @@ package dht
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
@@ -11,10 +12,13 @@ import (
 	"github.com/lwch/bencode"
 	"github.com/lwch/magic/code/data"
 	"github.com/lwch/magic/code/logging"
+	"github.com/lwch/magic/code/utp"
 )
 
 const neighborSize = 8
 const maxDiscoverySize = 32
+const maxPeerValues = 50
+const bootstrapWait = 10 * time.Second
 
 type hashType [20]byte
 
@@ -46,6 +50,22 @@ func (hash hashType) bit(n int) byte {
 	return hash[bt] >> 7
 }
 
+// xor distance between two hash
+func (hash hashType) xor(h hashType) hashType {
+	var ret hashType
+	for i := range hash {
+		ret[i] = hash[i] ^ h[i]
+	}
+	return ret
+}
+
+// closer is a closer to hash than b
+func (hash hashType) closer(a, b hashType) bool {
+	da := hash.xor(a)
+	db := hash.xor(b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
 type pkt struct {
 	data []byte
 	addr net.Addr
@@ -53,12 +73,20 @@ type pkt struct {
 
 // DHT dht manager
 type DHT struct {
-	listen   *net.UDPConn
+	listen   *net.UDPConn // ipv4
+	listen6  *net.UDPConn // ipv6, nil when not supported
+	utp      *utp.Socket  // utp connections on listen and listen6
 	tb       *table
+	tb6      *table
 	tx       *txMgr
 	init     *initQueue
 	res      *resMgr
-	local    hashType
+	token    *tokenMgr
+	peers    *peerStore
+	items    *itemStore
+	announce *announcer
+	sample   *sampler // nil when disabled
+	local    hashType // guarded by localLock, changed only in handler
 	chRead   chan pkt
 	minNodes int
 	even     int           // speed control
@@ -67,6 +95,23 @@ type DHT struct {
 	nodePool sync.Pool
 	gen      func() [20]byte
 
+	idFile        string
+	secureID      bool
+	enforceSecure bool
+	localLock     sync.RWMutex
+	voter         *ipVoter // votes of ipv4 address
+	voter6        *ipVoter // votes of ipv6 address
+	chExternal    chan net.IP
+	externalIP    net.IP // only used in handler
+	externalIP6   net.IP // only used in handler
+
+	bootstrap    []*net.UDPAddr
+	bootstrapped time.Time // last bootstrap retry in strict mode, only used in handler
+	nodesFile    string
+	readOnly     bool // never save nodes to nodesFile
+	saveInterval time.Duration
+	maxSaveNodes int
+
 	// runtime
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -79,11 +124,35 @@ func New(cfg *Config) (*DHT, error) {
 		local:    data.RandID(),
 		tx:       newTXMgr(cfg.TxTimeout),
 		init:     newInitQueue(),
+		token:    newTokenMgr(),
+		peers:    newPeerStore(cfg.MaxPeerHashes, cfg.MaxPeersPerHash, cfg.PeerTimeout),
+		items:    newItemStore(cfg.MaxItems, cfg.ItemTimeout),
 		chRead:   make(chan pkt, 1000),
 		minNodes: cfg.MinNodes,
 		Out:      make(chan MetaInfo),
 		Nodes:    make(chan int),
 		gen:      cfg.GenID,
+
+		nodesFile:    cfg.NodesFile,
+		readOnly:     cfg.NodesReadOnly,
+		saveInterval: cfg.SaveInterval,
+		maxSaveNodes: cfg.MaxSaveNodes,
+
+		idFile:        cfg.IDFile,
+		secureID:      cfg.SecureID,
+		enforceSecure: cfg.EnforceSecureID,
+		voter:         newIPVoter(),
+		voter6:        newIPVoter(),
+		chExternal:    make(chan net.IP, 2),
+	}
+	if cfg.NodeID != emptyHash {
+		dht.local = cfg.NodeID
+	} else if len(cfg.IDFile) > 0 {
+		id, err := loadID(cfg.IDFile)
+		if err != nil {
+			return nil, err
+		}
+		dht.local = id
 	}
 	dht.nodePool = sync.Pool{
 		New: func() interface{} {
@@ -91,38 +160,277 @@ func New(cfg *Config) (*DHT, error) {
 		},
 	}
 	// rand.Read(dht.local[:])
-	dht.tb = newTable(dht, neighborSize, cfg.MaxNodes, cfg.GenID, cfg.NodeFilter)
-	dht.res = newResMgr(dht)
+	dht.tb = newTable(dht, neighborSize, cfg.MaxNodes, cfg.StrictTable, cfg.GenID, cfg.NodeFilter)
+	dht.res = newResMgr(dht, cfg)
+	dht.announce = newAnnouncer(dht, cfg.ReAnnounce)
+	if cfg.Sample {
+		dht.sample = newSampler(dht)
+	}
 	dht.ctx, dht.cancel = context.WithCancel(context.Background())
 	var err error
-	dht.listen, err = net.ListenUDP("udp", &net.UDPAddr{
+	dht.listen, err = net.ListenUDP("udp4", &net.UDPAddr{
 		Port: int(cfg.Listen),
 	})
-	go dht.recv()
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.DisableIPv6 {
+		// http://www.bittorrent.org/beps/bep_0032.html
+		dht.listen6, err = net.ListenUDP("udp6", &net.UDPAddr{
+			IP:   net.IPv6unspecified,
+			Port: int(cfg.Listen),
+		})
+		if err != nil {
+			logging.Info("ipv6 not supported: %v", err)
+			dht.listen6 = nil
+		} else {
+			dht.tb6 = newTable(dht, neighborSize, cfg.MaxNodes, cfg.StrictTable, cfg.GenID, cfg.NodeFilter)
+		}
+	}
+	dht.utp = utp.NewSocket(dht.send, dht.listen.LocalAddr(), 0)
+	go dht.recv(dht.listen)
+	if dht.listen6 != nil {
+		go dht.recv(dht.listen6)
+	}
 	go dht.handler()
-	return dht, err
+	go dht.reportNodes()
+	return dht, nil
 }
 
 // Close close object
 func (dht *DHT) Close() {
+	err := dht.saveNodes()
+	if err != nil {
+		logging.Error("save nodes to %s failed: %v", dht.nodesFile, err)
+	}
 	dht.listen.Close()
-	dht.tb.close()
+	if dht.listen6 != nil {
+		dht.listen6.Close()
+	}
 	dht.tx.close()
 	dht.res.close()
+	dht.utp.Close()
 	dht.cancel()
 }
 
-// Discovery discovery nodes
+// localID get local node id
+func (dht *DHT) localID() hashType {
+	dht.localLock.RLock()
+	defer dht.localLock.RUnlock()
+	return dht.local
+}
+
+// voteIP vote external ip reported by remote, the voted ip is applied in handler
+func (dht *DHT) voteIP(from, ip net.IP) {
+	if !dht.secureID || ip == nil {
+		return
+	}
+	voter := dht.voter
+	if ip.To4() == nil {
+		voter = dht.voter6
+	}
+	ip = voter.vote(from, ip)
+	if ip == nil {
+		return
+	}
+	select {
+	case dht.chExternal <- ip:
+	default:
+	}
+}
+
+// setExternalIP change node id when it is not match the external ipv4 address,
+// the node id is not derived from ipv6 address to keep it stable in dual stack
+// http://www.bittorrent.org/beps/bep_0042.html
+func (dht *DHT) setExternalIP(ip net.IP) {
+	if ip.To4() == nil {
+		if !ip.Equal(dht.externalIP6) {
+			logging.Info("external ipv6: %s", ip.String())
+			dht.externalIP6 = ip
+		}
+		return
+	}
+	if ip.Equal(dht.externalIP) {
+		return
+	}
+	logging.Info("external ip: %s", ip.String())
+	dht.externalIP = ip
+	if checkSecureID(ip, dht.localID()) {
+		return
+	}
+	id := secureID(ip)
+	dht.localLock.Lock()
+	dht.local = id
+	dht.localLock.Unlock()
+	logging.Info("change node id to %s by external ip %s", id.String(), ip.String())
+	dht.tb.rekey(id)
+	if dht.tb6 != nil {
+		dht.tb6.rekey(id)
+	}
+	if len(dht.idFile) > 0 {
+		err := saveID(dht.idFile, id)
+		if err != nil {
+			logging.Error("save node id to %s failed: %v", dht.idFile, err)
+		}
+	}
+}
+
+// voteResp vote external ip by the ip field in response
+// http://www.bittorrent.org/beps/bep_0042.html
+func (dht *DHT) voteResp(addr net.UDPAddr, buf []byte) {
+	if !dht.secureID {
+		return
+	}
+	var rep struct {
+		IP string `bencode:"ip"`
+	}
+	err := bencode.Decode(buf, &rep)
+	if err != nil {
+		return
+	}
+	ip, _ := parseCompactAddr(rep.IP)
+	dht.voteIP(addr.IP, ip)
+}
+
+// Stats get counters of metadata fetch
+func (dht *DHT) Stats() FetchStats {
+	return dht.res.stats()
+}
+
+// FailedHashes get info_hash which failed to fetch metadata and in backoff
+func (dht *DHT) FailedHashes() []FailedHash {
+	return dht.res.neg.list()
+}
+
+// ClearFailed remove info_hash from failed cache, all are removed when hashes is empty
+func (dht *DHT) ClearFailed(hashes ...[20]byte) {
+	dht.res.neg.clear(hashes...)
+}
+
+// Discovery discovery nodes, the nodes saved in last run are used first,
+// bootstrap addrs are used only when there are not enough nodes alive
 func (dht *DHT) Discovery(addrs []*net.UDPAddr) {
-	for _, addr := range addrs {
+	dht.bootstrap = addrs
+	if dht.restore() < neighborSize {
+		dht.addBootstrap()
+		return
+	}
+	time.AfterFunc(bootstrapWait, func() {
+		if dht.size() < neighborSize {
+			logging.Info("not enough saved nodes alive, add bootstrap nodes")
+			dht.addBootstrap()
+		}
+	})
+}
+
+func (dht *DHT) addBootstrap() {
+	if dht.tb.strict {
+		go dht.lookupBootstrap()
+		return
+	}
+	for _, addr := range dht.bootstrap {
+		if addr.IP.To4() == nil && dht.listen6 == nil {
+			continue
+		}
 		node := newBootstrapNode(dht, *addr)
 		node.sendDiscovery(dht.gen)
-		dht.tb.add(node)
+		dht.tableFor(addr.IP).add(node)
+	}
+	dht.discovery()
+}
+
+// lookupBootstrap lookup local id to fill the strict routing table,
+// the bootstrap nodes are used only as lookup seeds
+// http://www.bittorrent.org/beps/bep_0005.html#routing-table
+func (dht *DHT) lookupBootstrap() {
+	lk, err := dht.newLookup(data.TypeFindNode, dht.localID())
+	if err != nil {
+		logging.Error("bootstrap lookup failed: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(dht.ctx, time.Minute)
+	defer cancel()
+	lk.run(ctx)
+}
+
+// isBootstrapAddr the address is one of bootstrap nodes
+func (dht *DHT) isBootstrapAddr(addr net.UDPAddr) bool {
+	for _, bootstrap := range dht.bootstrap {
+		if bootstrap.IP.Equal(addr.IP) && bootstrap.Port == addr.Port {
+			return true
+		}
+	}
+	return false
+}
+
+func (dht *DHT) discovery() {
+	// retry bootstrap when all nodes are gone in strict mode
+	if dht.tb.strict && dht.size() == 0 &&
+		time.Since(dht.bootstrapped) >= bootstrapWait {
+		dht.bootstrapped = time.Now()
+		go dht.lookupBootstrap()
 	}
 	dht.tb.discovery(maxDiscoverySize)
+	if dht.tb6 != nil {
+		dht.tb6.discovery(maxDiscoverySize)
+	}
+}
+
+// tableFor get routing table by address family
+func (dht *DHT) tableFor(ip net.IP) *table {
+	if ip.To4() == nil && dht.tb6 != nil {
+		return dht.tb6
+	}
+	return dht.tb
+}
+
+// send send packet by address family
+func (dht *DHT) send(buf []byte, addr *net.UDPAddr) error {
+	conn := dht.listen
+	if addr.IP.To4() == nil {
+		if dht.listen6 == nil {
+			return errors.New("ipv6 not supported")
+		}
+		conn = dht.listen6
+	}
+	_, err := conn.WriteTo(buf, addr)
+	return err
+}
+
+// want nodes in find_node and get_peers request
+func (dht *DHT) want() []string {
+	if dht.listen6 == nil {
+		return []string{data.WantNodes4}
+	}
+	return []string{data.WantNodes4, data.WantNodes6}
+}
+
+func (dht *DHT) size() int {
+	size := dht.tb.count()
+	if dht.tb6 != nil {
+		size += dht.tb6.count()
+	}
+	return size
+}
+
+func (dht *DHT) reportNodes() {
+	tk := time.NewTicker(time.Second)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			select {
+			case dht.Nodes <- dht.size():
+			case <-dht.ctx.Done():
+				return
+			}
+		case <-dht.ctx.Done():
+			return
+		}
+	}
 }
 
-func (dht *DHT) recv() {
+func (dht *DHT) recv(conn *net.UDPConn) {
 	buf := make([]byte, 65535)
 	for {
 		select {
@@ -130,11 +438,15 @@ func (dht *DHT) recv() {
 			return
 		default:
 		}
-		dht.listen.SetReadDeadline(time.Now().Add(time.Second))
-		n, addr, err := dht.listen.ReadFrom(buf)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
 			continue
 		}
+		// krpc packet is started with 'd', the others may be utp
+		if buf[0] != 'd' && dht.utp.Handle(addr.(*net.UDPAddr), buf[:n]) {
+			continue
+		}
 		data := make([]byte, n)
 		copy(data, buf[:n])
 		select {
@@ -150,15 +462,39 @@ func (dht *DHT) recv() {
 
 func (dht *DHT) handler() {
 	tk := time.Tick(time.Second)
+	clearTk := time.Tick(time.Minute)
+	saveTk := time.Tick(dht.saveInterval)
 	for {
 		select {
+		case <-saveTk:
+			err := dht.saveNodes()
+			if err != nil {
+				logging.Error("save nodes to %s failed: %v", dht.nodesFile, err)
+			}
 		case pkt := <-dht.chRead:
 			dht.handleData(pkt.addr, pkt.data)
+		case ip := <-dht.chExternal:
+			dht.setExternalIP(ip)
+		case <-clearTk:
+			dht.peers.clearTimeout()
+			dht.items.clearTimeout()
+			dht.res.clearTimeout()
+			dht.tb.refresh()
+			if dht.tb6 != nil {
+				dht.tb6.refresh()
+			}
+			if dht.sample != nil {
+				dht.sample.clearTimeout()
+			}
+			go dht.announce.check()
 		case <-tk:
-			if dht.tb.size < dht.minNodes {
-				dht.tb.discovery(maxDiscoverySize)
+			if dht.size() < dht.minNodes {
+				dht.discovery()
 			} else if dht.tx.size() == 0 {
-				dht.tb.discovery(maxDiscoverySize)
+				dht.discovery()
+			}
+			if dht.sample != nil {
+				dht.sample.crawl()
 			}
 		case <-dht.ctx.Done():
 			return
@@ -167,36 +503,32 @@ func (dht *DHT) handler() {
 }
 
 func (dht *DHT) handleData(addr net.Addr, buf []byte) {
-	node := dht.tb.findAddr(addr)
+	hdr, err := data.ParsePacket(buf)
+	if err != nil {
+		return
+	}
+	tb := dht.tableFor(addr.(*net.UDPAddr).IP)
+	node := tb.findAddr(addr)
 	if node == nil {
-		var hdr data.Hdr
-		err := bencode.Decode(buf, &hdr)
-		if err != nil {
-			return
-		}
 		switch {
 		case hdr.IsRequest():
-			var req struct {
-				data.Hdr
-				Data struct {
-					ID [20]byte `bencode:"id"`
-				} `bencode:"a"`
-			}
-			err = bencode.Decode(buf, &req)
-			if err != nil {
-				return
-			}
-			if bytes.Equal(req.Data.ID[:], emptyHash[:]) {
+			if bytes.Equal(hdr.ID[:], emptyHash[:]) {
+				dht.sendError(addr.(*net.UDPAddr), hdr.Transaction, data.ErrProtocol, "missing id")
 				return
 			}
-			node = dht.tb.findID(req.Data.ID)
+			node = tb.findID(hdr.ID)
 			if node == nil {
-				node = newNode(dht, req.Data.ID, *addr.(*net.UDPAddr))
-				dht.tb.add(node)
+				node = newNode(dht, hdr.ID, *addr.(*net.UDPAddr))
+				tb.add(node)
 			}
 		case hdr.IsResponse():
 			node = dht.init.find(hdr.Transaction)
 			if node == nil {
+				txr := dht.tx.find(hdr.Transaction)
+				if txr != nil && txr.lk != nil {
+					dht.voteResp(*addr.(*net.UDPAddr), buf)
+					txr.lk.recv(*addr.(*net.UDPAddr), buf)
+				}
 				return
 			}
 			node.updated = time.Now()
@@ -205,9 +537,31 @@ func (dht *DHT) handleData(addr net.Addr, buf []byte) {
 			default:
 			}
 			return
+		case hdr.IsError():
+			// the request is failed, stop waiting for it
+			dht.init.unset(hdr.Transaction)
+			txr := dht.tx.find(hdr.Transaction)
+			if txr != nil && txr.lk != nil {
+				txr.lk.fail(*addr.(*net.UDPAddr))
+			}
+			return
 		default:
 			return
 		}
 	}
-	node.onRecv(buf)
+	node.onRecv(buf, hdr)
+}
+
+// http://www.bittorrent.org/beps/bep_0005.html#errors
+func (dht *DHT) sendError(addr *net.UDPAddr, tx string, code int, msg string) {
+	buf, err := data.ErrorRep(tx, code, msg)
+	if err != nil {
+		logging.Error("build error response packet failed, addr=%s, err=%v", addr.String(), err)
+		return
+	}
+	err = dht.send(buf, addr)
+	if err != nil {
+		logging.Error("send error response packet failed, addr=%s, err=%v", addr.String(), err)
+		return
+	}
 }
@@ -0,0 +1,61 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+)
+
+const maxOneShotPeers = 200 // max peers to try of Fetch
+
+// Fetch download metadata of info_hash once, the peers are found by get_peers
+// lookup, announced to us and given by caller such as x.pe in magnet link.
+// it bypasses the fetch queue, seen set, backoff and Config.ShouldFetch,
+// so it returns when ctx is done and never blocks on Out
+func (dht *DHT) Fetch(ctx context.Context, hash [20]byte, peers ...net.Addr) (*MetaInfo, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	id := hashType(hash)
+	job := newFetchJob(dht.res, id)
+	job.maxPeers = maxOneShotPeers
+	for _, addr := range peers {
+		if r, ok := peerReq(id, addr); ok {
+			job.addPeer(r)
+		}
+	}
+	for _, r := range dht.res.announced(id) {
+		job.addPeer(r)
+	}
+	ch, err := dht.GetPeers(ctx, hash)
+	if err != nil && len(peers) == 0 {
+		return nil, err
+	}
+	if err == nil {
+		go func() {
+			for addr := range ch {
+				if r, ok := peerReq(id, addr); ok {
+					job.addPeer(r)
+				}
+			}
+		}()
+	}
+	info := job.run(ctx)
+	if info == nil {
+		return nil, errors.New(job.reason())
+	}
+	return info, nil
+}
+
+func peerReq(id hashType, addr net.Addr) (resReq, bool) {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return resReq{}, false
+	}
+	ip := net.ParseIP(host)
+	n, _ := strconv.Atoi(port)
+	if ip == nil || n <= 0 || n > 65535 {
+		return resReq{}, false
+	}
+	return resReq{id: id, ip: ip, port: uint16(n)}, true
+}
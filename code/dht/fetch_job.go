@@ -0,0 +1,406 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/lwch/magic/code/logging"
+)
+
+// fetchJob fetch metadata of one info_hash from multiple peers,
+// each piece can be downloaded from different peer
+// http://www.bittorrent.org/beps/bep_0009.html
+type fetchJob struct {
+	sync.Mutex
+	mgr      *resMgr
+	id       hashType
+	peers    []resReq // candidate peers not tried
+	tried    map[string]bool
+	maxPeers int
+	metaSize int
+	pieces   [][]byte
+	owners   []string // peer address of each piece, empty when not downloaded
+	claimed  []bool
+	single   bool     // download all pieces from one peer after hash mismatch
+	mismatch []resReq // peers skipped by metadata size mismatch, retried in single mode
+	finished bool
+	info     *MetaInfo
+	err      error // the last error
+	chWake   chan struct{}
+	cond     *sync.Cond // signaled when pieces are released, downloaded or job is stopped
+}
+
+func newFetchJob(mgr *resMgr, id hashType) *fetchJob {
+	job := &fetchJob{
+		mgr:      mgr,
+		id:       id,
+		tried:    make(map[string]bool),
+		maxPeers: maxFetchPeers,
+		chWake:   make(chan struct{}, 1),
+	}
+	job.cond = sync.NewCond(&job.Mutex)
+	return job
+}
+
+func (job *fetchJob) setErr(err error) {
+	job.Lock()
+	job.err = err
+	job.Unlock()
+}
+
+// reason failed reason of job
+func (job *fetchJob) reason() string {
+	job.Lock()
+	defer job.Unlock()
+	if job.err != nil {
+		return job.err.Error()
+	}
+	if len(job.tried) == 0 {
+		return "no peers"
+	}
+	return "timeout"
+}
+
+func (job *fetchJob) wake() {
+	select {
+	case job.chWake <- struct{}{}:
+	default:
+	}
+}
+
+func (job *fetchJob) addPeer(r resReq) {
+	job.Lock()
+	defer job.Unlock()
+	addr := r.addr()
+	if job.tried[addr] || len(job.tried)+len(job.peers) >= job.maxPeers {
+		return
+	}
+	for _, peer := range job.peers {
+		if peer.addr() == addr {
+			return
+		}
+	}
+	job.peers = append(job.peers, r)
+	job.wake()
+}
+
+// next pop the next candidate peer which is not bad
+func (job *fetchJob) next() (resReq, bool) {
+	job.Lock()
+	defer job.Unlock()
+	for len(job.peers) > 0 {
+		r := job.peers[0]
+		job.peers = job.peers[1:]
+		job.tried[r.addr()] = true
+		if !job.mgr.isBad(r.addr()) {
+			return r, true
+		}
+	}
+	return resReq{}, false
+}
+
+// run fetch metadata until ctx is done, returns nil when failed.
+// the connections of workers are closed and the workers are exited when it returns
+func (job *fetchJob) run(ctx context.Context) *MetaInfo {
+	ctx, cancel := context.WithCancel(ctx)
+	running := 0
+	chExit := make(chan struct{}, job.mgr.concurrency)
+	defer func() {
+		job.Lock()
+		job.finished = true
+		job.cond.Broadcast()
+		job.Unlock()
+		cancel()
+		for ; running > 0; running-- {
+			<-chExit
+		}
+	}()
+	for {
+		for running < job.mgr.concurrency {
+			r, ok := job.next()
+			if !ok {
+				break
+			}
+			running++
+			go func() {
+				job.work(ctx, r)
+				chExit <- struct{}{}
+			}()
+		}
+		job.Lock()
+		info, finished := job.info, job.finished
+		job.Unlock()
+		if finished {
+			return nil
+		}
+		if info != nil {
+			return info
+		}
+		if running == 0 && job.retryMismatch() {
+			continue
+		}
+		select {
+		case <-chExit:
+			running--
+		case <-job.chWake:
+		case <-ctx.Done():
+			logging.Debug("*GET* fetch %s timeout", job.id.String())
+			return nil
+		case <-job.mgr.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// work download the missing pieces from peer
+func (job *fetchJob) work(ctx context.Context, r resReq) {
+	addr := r.addr()
+	c, err := job.mgr.connect(ctx, r)
+	if err != nil {
+		job.setErr(err)
+		return
+	}
+	defer c.Close()
+	metaData, metaSize, pieces := c.metaData, c.metaSize, c.pieces
+	if !job.setSize(r, metaSize, pieces) {
+		// not sure which size is right, the peer is retried in single mode
+		logging.Info("*GET* metadata size mismatch, size=%d"+r.logInfo(), metaSize)
+		job.setErr(errSizeMismatch)
+		return
+	}
+	logging.Info("*GET* resource %s from %s, pieces=%d, size=%d",
+		r.id.String(), addr, pieces, metaSize)
+	for {
+		n, single := job.claim(addr)
+		if single {
+			job.fetchAll(c, metaData, metaSize, pieces, r)
+			return
+		}
+		if n < 0 {
+			return
+		}
+		data, err := job.download(c, metaData, n)
+		if err != nil {
+			job.setErr(err)
+			job.release(n)
+			return
+		}
+		job.setPiece(n, data, r)
+	}
+}
+
+func (job *fetchJob) download(c net.Conn, metaData byte, n int) ([]byte, error) {
+	err := requestPiece(c, metaData, n)
+	if err != nil {
+		return nil, err
+	}
+	return readPiece(c, n)
+}
+
+// setSize set metadata size by the first peer, returns false when not matched,
+// each peer uses its own size in single mode
+func (job *fetchJob) setSize(r resReq, size, pieces int) bool {
+	job.Lock()
+	defer job.Unlock()
+	if job.single {
+		return true
+	}
+	if job.pieces == nil {
+		job.metaSize = size
+		job.pieces = make([][]byte, pieces)
+		job.owners = make([]string, pieces)
+		job.claimed = make([]bool, pieces)
+		return true
+	}
+	if job.metaSize != size {
+		job.mismatch = append(job.mismatch, r)
+		return false
+	}
+	return true
+}
+
+func (job *fetchJob) stopped(addr string) bool {
+	return job.finished || job.info != nil || job.mgr.isBad(addr)
+}
+
+// claim get the index of missing piece which not downloading, -1 when no more pieces,
+// it waits when the missing pieces are all downloading by other peers,
+// returns true when the pieces must be downloaded from one peer
+func (job *fetchJob) claim(addr string) (int, bool) {
+	job.Lock()
+	defer job.Unlock()
+	for {
+		if job.stopped(addr) {
+			return -1, false
+		}
+		if job.single {
+			return -1, true
+		}
+		missing := false
+		for i := range job.pieces {
+			if len(job.owners[i]) > 0 {
+				continue
+			}
+			missing = true
+			if !job.claimed[i] {
+				job.claimed[i] = true
+				return i, false
+			}
+		}
+		if !missing {
+			return -1, false
+		}
+		job.cond.Wait()
+	}
+}
+
+// fetchAll download all pieces from peer by its metadata size,
+// the peer is set bad when hash mismatch
+func (job *fetchJob) fetchAll(c net.Conn, metaData byte, size, pieces int, r resReq) {
+	raw := make([]byte, 0, size)
+	for i := 0; i < pieces; i++ {
+		job.Lock()
+		stopped := job.stopped(r.addr())
+		job.Unlock()
+		if stopped {
+			return
+		}
+		data, err := job.download(c, metaData, i)
+		if err != nil {
+			job.setErr(err)
+			return
+		}
+		raw = append(raw, data...)
+	}
+	if len(raw) != size {
+		logging.Info("*GET* invalid metadata size %d"+r.logInfo(), len(raw))
+		job.setErr(errPieceSize)
+		job.mgr.setBad(r.addr())
+		return
+	}
+	job.Lock()
+	defer job.Unlock()
+	defer job.wake()
+	if job.info != nil {
+		return
+	}
+	if !verifyInfo(job.id, raw) {
+		logging.Info("*GET* hash mismatch, set bad peer" + r.logInfo())
+		job.err = errHashMismatch
+		job.mgr.setBad(r.addr())
+		return
+	}
+	job.setInfo(r, raw)
+}
+
+func (job *fetchJob) release(n int) {
+	job.Lock()
+	if !job.single {
+		job.claimed[n] = false
+	}
+	job.cond.Broadcast()
+	job.Unlock()
+	job.wake()
+}
+
+// setPiece save piece data, the metadata is verified when all pieces downloaded
+func (job *fetchJob) setPiece(n int, data []byte, r resReq) {
+	job.Lock()
+	defer job.Unlock()
+	defer job.cond.Broadcast()
+	// the pieces are dropped in single mode
+	if job.single {
+		return
+	}
+	job.claimed[n] = false
+	if len(job.owners[n]) > 0 {
+		return
+	}
+	size := blockSize
+	if n == len(job.pieces)-1 {
+		size = job.metaSize - n*blockSize
+	}
+	if len(data) != size {
+		logging.Info("*GET* invalid piece %d size %d"+r.logInfo(), n, len(data))
+		job.err = errPieceSize
+		job.mgr.setBad(r.addr())
+		return
+	}
+	job.pieces[n] = data
+	job.owners[n] = r.addr()
+	for _, owner := range job.owners {
+		if len(owner) == 0 {
+			return
+		}
+	}
+	defer job.wake()
+	raw := make([]byte, 0, job.metaSize)
+	for _, piece := range job.pieces {
+		raw = append(raw, piece...)
+	}
+	if !verifyInfo(job.id, raw) {
+		// not sure which peer is bad, retry them one by one
+		logging.Info("*GET* hash mismatch, id=%s, retry by single peer", job.id.String())
+		job.err = errHashMismatch
+		job.setSingle()
+		return
+	}
+	job.setInfo(r, raw)
+}
+
+// retryMismatch switch to single mode when no peer is working on the pieces
+// and some peers are skipped by size mismatch, returns true when switched
+func (job *fetchJob) retryMismatch() bool {
+	job.Lock()
+	defer job.Unlock()
+	if job.single || job.finished || job.info != nil ||
+		len(job.mismatch) == 0 || len(job.peers) > 0 {
+		return false
+	}
+	logging.Info("*GET* metadata size mismatch, id=%s, retry by single peer", job.id.String())
+	job.setSingle()
+	return true
+}
+
+// setSingle retry the owners of pieces and the peers skipped by size mismatch
+// one by one, the metadata size is reset since it may be reported by bad peer
+func (job *fetchJob) setSingle() {
+	job.single = true
+	job.cond.Broadcast()
+	for _, owner := range job.owners {
+		if job.tried[owner] {
+			delete(job.tried, owner)
+			job.peers = append(job.peers, job.peerOf(owner))
+		}
+	}
+	for _, r := range job.mismatch {
+		if job.tried[r.addr()] {
+			delete(job.tried, r.addr())
+			job.peers = append(job.peers, r)
+		}
+	}
+	job.mismatch = nil
+	job.metaSize = 0
+	job.pieces = nil
+	job.owners = nil
+	job.claimed = nil
+}
+
+func (job *fetchJob) peerOf(addr string) resReq {
+	host, port, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(port)
+	return resReq{id: job.id, ip: net.ParseIP(host), port: uint16(n)}
+}
+
+func (job *fetchJob) setInfo(r resReq, raw []byte) {
+	info, err := parseMetaInfo(r, raw, job.mgr.dropPad)
+	if err != nil {
+		logging.Error("*GET* decode data body failed" + r.errInfo(err))
+		job.err = err
+		job.finished = true
+		return
+	}
+	job.info = info
+}
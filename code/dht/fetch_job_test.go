@@ -0,0 +1,376 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lwch/bencode"
+	"github.com/lwch/magic/code/mse"
+	"github.com/lwch/magic/code/utp"
+)
+
+// fakePeer serve metadata of size with data raw, the connection is closed
+// after limit pieces served when limit > 0, and only choke message is sent
+// when limit < 0
+type fakePeer struct {
+	l         net.Listener
+	raw       []byte
+	size      int
+	limit     int
+	closed    chan struct{} // closed when choke message failed to send
+	requested chan struct{} // closed when the first request received, only for reject peer
+	reject    chan struct{} // the request is rejected after it is closed, nil to serve
+}
+
+func newFakePeer(t *testing.T, raw []byte, size, limit int) *fakePeer {
+	p := &fakePeer{raw: raw, size: size, limit: limit, closed: make(chan struct{})}
+	p.listen(t)
+	return p
+}
+
+// newRejectPeer the peer rejects the first request after reject is closed
+func newRejectPeer(t *testing.T, size int) *fakePeer {
+	p := &fakePeer{
+		size:      size,
+		limit:     1,
+		closed:    make(chan struct{}),
+		requested: make(chan struct{}),
+		reject:    make(chan struct{}),
+	}
+	p.listen(t)
+	return p
+}
+
+func (p *fakePeer) listen(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.l = l
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(c)
+		}
+	}()
+}
+
+// listenUTP serve by utp on the port of tcp listener, returns the close function
+func (p *fakePeer) listenUTP(t *testing.T) func() {
+	addr := p.l.Addr().(*net.TCPAddr)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: addr.IP, Port: addr.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := utp.NewSocket(func(buf []byte, addr *net.UDPAddr) error {
+		_, err := conn.WriteToUDP(buf, addr)
+		return err
+	}, conn.LocalAddr(), 16)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			s.Handle(addr, append([]byte(nil), buf[:n]...))
+		}
+	}()
+	go func() {
+		for {
+			c, err := s.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(c)
+		}
+	}()
+	return func() {
+		s.Close()
+		conn.Close()
+	}
+}
+
+func (p *fakePeer) req(id hashType) resReq {
+	addr := p.l.Addr().(*net.TCPAddr)
+	return resReq{id: id, ip: addr.IP, port: uint16(addr.Port)}
+}
+
+func (p *fakePeer) serve(c net.Conn) {
+	defer c.Close()
+	err := readHandshake(c)
+	if err != nil {
+		return
+	}
+	_, err = c.Write(makeHandshake(emptyHash))
+	if err != nil {
+		return
+	}
+	_, _, _, err = readMessage(c)
+	if err != nil {
+		return
+	}
+	hdr := fmt.Sprintf("d1:md11:ut_metadatai1ee13:metadata_sizei%dee", p.size)
+	err = sendMessage(c, extMsgID, 0, []byte(hdr))
+	if err != nil {
+		return
+	}
+	for p.limit < 0 {
+		err = sendMessage(c, 0, 0, nil)
+		if err != nil {
+			close(p.closed)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for served := 0; p.limit == 0 || served < p.limit; served++ {
+		_, _, payload, err := readMessage(c)
+		if err != nil {
+			return
+		}
+		var req struct {
+			Piece int `bencode:"piece"`
+		}
+		err = bencode.Decode(payload, &req)
+		if err != nil {
+			return
+		}
+		if p.reject != nil {
+			close(p.requested)
+			<-p.reject
+			rep := fmt.Sprintf("d8:msg_typei2e5:piecei%dee", req.Piece)
+			sendMessage(c, extMsgID, 1, []byte(rep))
+			return
+		}
+		end := (req.Piece + 1) * blockSize
+		if end > len(p.raw) {
+			end = len(p.raw)
+		}
+		rep := fmt.Sprintf("d8:msg_typei1e5:piecei%de10:total_sizei%dee", req.Piece, p.size)
+		err = sendMessage(c, extMsgID, 1, append([]byte(rep), p.raw[req.Piece*blockSize:end]...))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// testInfo info dictionary of 3 pieces
+func testInfo() ([]byte, hashType) {
+	pieces := strings.Repeat("x", 20*2000)
+	info := []byte(fmt.Sprintf("d6:lengthi%de4:name4:test12:piece lengthi16384e6:pieces%d:%se",
+		2000*16384, len(pieces), pieces))
+	return info, hashType(sha1.Sum(info))
+}
+
+func newTestFetch(t *testing.T, port uint16) *DHT {
+	cfg := NewConfig()
+	cfg.Listen = port
+	cfg.DisableIPv6 = true
+	cfg.FetchTransport = TransportTCP
+	cfg.FetchEncryption = mse.PolicyPlaintext
+	// workers run one by one
+	cfg.FetchConcurrency = 1
+	dht, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dht
+}
+
+func runTestJob(t *testing.T, job *fetchJob) *MetaInfo {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	info := job.run(ctx)
+	if info == nil {
+		t.Fatal(job.reason())
+	}
+	return info
+}
+
+func TestFetchMultiPeers(t *testing.T) {
+	dht := newTestFetch(t, 16887)
+	defer dht.Close()
+	info, id := testInfo()
+	job := newFetchJob(dht.res, id)
+	// each peer serves only one piece
+	for i := 0; i < 3; i++ {
+		p := newFakePeer(t, info, len(info), 1)
+		defer p.l.Close()
+		job.addPeer(p.req(id))
+	}
+	mi := runTestJob(t, job)
+	if !bytes.Equal(mi.Raw, info) {
+		t.Fatal("metadata mismatch")
+	}
+	owners := make(map[string]bool)
+	for _, owner := range job.owners {
+		owners[owner] = true
+	}
+	if len(owners) != 3 {
+		t.Fatalf("unexpected owners: %v", job.owners)
+	}
+}
+
+func TestFetchHashMismatch(t *testing.T) {
+	dht := newTestFetch(t, 16888)
+	defer dht.Close()
+	info, id := testInfo()
+	bad := append([]byte(nil), info...)
+	bad[blockSize+1] ^= 0xff
+	badPeer := newFakePeer(t, bad, len(bad), 0)
+	defer badPeer.l.Close()
+	goodPeer := newFakePeer(t, info, len(info), 0)
+	defer goodPeer.l.Close()
+	job := newFetchJob(dht.res, id)
+	job.addPeer(badPeer.req(id))
+	job.addPeer(goodPeer.req(id))
+	mi := runTestJob(t, job)
+	if !bytes.Equal(mi.Raw, info) || !job.single {
+		t.Fatal("not fetched by single peer")
+	}
+	if dht.res.isBad(goodPeer.req(id).addr()) {
+		t.Fatal("good peer is set bad")
+	}
+}
+
+func TestFetchSizeMismatch(t *testing.T) {
+	dht := newTestFetch(t, 16889)
+	defer dht.Close()
+	info, id := testInfo()
+	// the first peer reports wrong size and serves one piece only
+	bad := bytes.Repeat([]byte("x"), len(info)+100)
+	badPeer := newFakePeer(t, bad, len(bad), 1)
+	defer badPeer.l.Close()
+	goodPeer := newFakePeer(t, info, len(info), 0)
+	defer goodPeer.l.Close()
+	job := newFetchJob(dht.res, id)
+	job.addPeer(badPeer.req(id))
+	job.addPeer(goodPeer.req(id))
+	mi := runTestJob(t, job)
+	if !bytes.Equal(mi.Raw, info) {
+		t.Fatal("metadata mismatch")
+	}
+	if dht.res.isBad(goodPeer.req(id).addr()) {
+		t.Fatal("good peer is set bad")
+	}
+}
+
+func TestFetchStop(t *testing.T) {
+	dht := newTestFetch(t, 16890)
+	defer dht.Close()
+	info, id := testInfo()
+	p := newFakePeer(t, info, len(info), -1)
+	defer p.l.Close()
+	job := newFetchJob(dht.res, id)
+	job.addPeer(p.req(id))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	begin := time.Now()
+	if job.run(ctx) != nil {
+		t.Fatal("unexpected metadata")
+	}
+	if time.Since(begin) > 3*time.Second {
+		t.Fatalf("job stopped after %s", time.Since(begin))
+	}
+	select {
+	case <-p.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection is not closed")
+	}
+}
+
+func TestFetchReject(t *testing.T) {
+	dht := newTestFetch(t, 16892)
+	defer dht.Close()
+	dht.res.concurrency = 3
+	info := []byte("d6:lengthi1e4:name4:test12:piece lengthi16384e6:pieces20:" +
+		strings.Repeat("x", 20) + "e")
+	id := hashType(sha1.Sum(info))
+	reject := newRejectPeer(t, len(info))
+	defer reject.l.Close()
+	job := newFetchJob(dht.res, id)
+	job.addPeer(reject.req(id))
+	ch := make(chan *MetaInfo)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ch <- job.run(ctx)
+	}()
+	// the only piece is claimed by reject peer
+	<-reject.requested
+	for i := 0; i < 2; i++ {
+		p := newFakePeer(t, info, len(info), 0)
+		defer p.l.Close()
+		job.addPeer(p.req(id))
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(reject.reject)
+	mi := <-ch
+	if mi == nil {
+		t.Fatal(job.reason())
+	}
+	if !bytes.Equal(mi.Raw, info) {
+		t.Fatal("metadata mismatch")
+	}
+}
+
+func TestFetchDropped(t *testing.T) {
+	dht := newTestFetch(t, 16893)
+	defer dht.Close()
+	dht.res.timeout = 500 * time.Millisecond
+	info, id := testInfo()
+	p := newFakePeer(t, info, len(info), 0)
+	defer p.l.Close()
+	job := newFetchJob(dht.res, id)
+	job.addPeer(p.req(id))
+	dht.res.jobs[id] = job
+	// output is blocked
+	dht.res.get(id, make(chan MetaInfo))
+	if dht.res.seen.has(id) {
+		t.Fatal("dropped info_hash is seen")
+	}
+	stats := dht.Stats()
+	if stats.Dropped != 1 || stats.Succeeded != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	job = newFetchJob(dht.res, id)
+	job.addPeer(p.req(id))
+	dht.res.jobs[id] = job
+	out := make(chan MetaInfo, 1)
+	dht.res.get(id, out)
+	if len(out) != 1 || !dht.res.seen.has(id) {
+		t.Fatal("delivered info_hash is not seen")
+	}
+}
+
+func TestConnectParallel(t *testing.T) {
+	dht := newTestFetch(t, 16900)
+	defer dht.Close()
+	dht.res.transport = TransportParallel
+	info, id := testInfo()
+	p := newFakePeer(t, info, len(info), 0)
+	defer p.l.Close()
+	defer p.listenUTP(t)()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pc, err := dht.res.connect(ctx, p.req(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.Close()
+	// wait for the slower one
+	time.Sleep(time.Second)
+	stats := dht.Stats()
+	if stats.TCP+stats.UTP != 1 {
+		t.Fatalf("unexpected connections: tcp=%d, utp=%d", stats.TCP, stats.UTP)
+	}
+}
@@ -0,0 +1,207 @@
+package dht
+
+import (
+	"container/heap"
+	"net"
+	"sync"
+	"time"
+)
+
+const maxQueueIPs = 1000        // max distinct ips counted of each info_hash
+const maxPendingQueries = 10000 // max info_hash of get_peers query counted before queued
+
+type queueItem struct {
+	id        hashType
+	announces int
+	ips       map[string]bool
+	queries   int
+	first     time.Time
+	score     float64
+	index     int
+}
+
+// itemHeap max heap by score
+type itemHeap []*queueItem
+
+func (h itemHeap) Len() int           { return len(h) }
+func (h itemHeap) Less(i, j int) bool { return h[i].score > h[j].score }
+func (h itemHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *itemHeap) Push(x interface{}) {
+	item := x.(*queueItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *itemHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// fetchQueue priority queue of info_hash to fetch metadata
+type fetchQueue struct {
+	sync.Mutex
+	heap     itemHeap
+	index    map[hashType]*queueItem
+	pending  map[hashType]int // get_peers queries of info_hash not queued
+	max      int
+	drop     DropPolicy
+	weights  PriorityWeights
+	created  time.Time
+	chNotify chan struct{}
+}
+
+func newFetchQueue(max int, drop DropPolicy, weights PriorityWeights) *fetchQueue {
+	return &fetchQueue{
+		index:    make(map[hashType]*queueItem),
+		pending:  make(map[hashType]int),
+		max:      max,
+		drop:     drop,
+		weights:  weights,
+		created:  time.Now(),
+		chNotify: make(chan struct{}, 1),
+	}
+}
+
+// calc the age part is calculated by first seen time, so that the order
+// of items is not changed as time goes by
+func (q *fetchQueue) calc(item *queueItem) {
+	w := q.weights
+	item.score = w.Announce*float64(item.announces) +
+		w.IP*float64(len(item.ips)) +
+		w.Query*float64(item.queries) -
+		w.Age*item.first.Sub(q.created).Minutes()
+}
+
+func (q *fetchQueue) notify() {
+	select {
+	case q.chNotify <- struct{}{}:
+	default:
+	}
+}
+
+// announce add announce of info_hash when it is queued
+func (q *fetchQueue) announce(id hashType, ip net.IP) {
+	q.Lock()
+	defer q.Unlock()
+	q.update(id, ip)
+}
+
+func (q *fetchQueue) update(id hashType, ip net.IP) bool {
+	item, ok := q.index[id]
+	if !ok {
+		return false
+	}
+	item.announces++
+	if len(item.ips) < maxQueueIPs {
+		item.ips[ip.String()] = true
+	}
+	q.calc(item)
+	heap.Fix(&q.heap, item.index)
+	return true
+}
+
+// push add info_hash to queue, returns the dropped info_hash when queue is full,
+// it may be the pushed one
+func (q *fetchQueue) push(id hashType, ip net.IP) []hashType {
+	q.Lock()
+	defer q.Unlock()
+	if q.update(id, ip) {
+		return nil
+	}
+	item := &queueItem{
+		id:        id,
+		announces: 1,
+		ips:       map[string]bool{ip.String(): true},
+		queries:   q.pending[id],
+		first:     time.Now(),
+	}
+	delete(q.pending, id)
+	q.calc(item)
+	var dropped []hashType
+	if len(q.heap) >= q.max {
+		victim := q.victim(item)
+		if victim == nil {
+			return []hashType{id}
+		}
+		heap.Remove(&q.heap, victim.index)
+		delete(q.index, victim.id)
+		dropped = append(dropped, victim.id)
+	}
+	heap.Push(&q.heap, item)
+	q.index[id] = item
+	q.notify()
+	return dropped
+}
+
+// victim the item to drop when queue is full, nil means drop the new item
+func (q *fetchQueue) victim(item *queueItem) *queueItem {
+	var ret *queueItem
+	switch q.drop {
+	case DropOldest:
+		for _, it := range q.heap {
+			if ret == nil || it.first.Before(ret.first) {
+				ret = it
+			}
+		}
+	case DropLowest:
+		for _, it := range q.heap {
+			if ret == nil || it.score < ret.score {
+				ret = it
+			}
+		}
+		if ret != nil && item.score <= ret.score {
+			return nil
+		}
+	}
+	return ret
+}
+
+// demand add get_peers query of info_hash, it is counted in pending
+// when info_hash is not queued and carried over by push
+func (q *fetchQueue) demand(id hashType) {
+	q.Lock()
+	defer q.Unlock()
+	item, ok := q.index[id]
+	if !ok {
+		_, ok = q.pending[id]
+		if !ok && len(q.pending) >= maxPendingQueries {
+			// most of them will never be announced
+			q.pending = make(map[hashType]int)
+		}
+		q.pending[id]++
+		return
+	}
+	item.queries++
+	q.calc(item)
+	heap.Fix(&q.heap, item.index)
+}
+
+// pop the info_hash with highest priority
+func (q *fetchQueue) pop() (hashType, bool) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.heap) == 0 {
+		return emptyHash, false
+	}
+	item := heap.Pop(&q.heap).(*queueItem)
+	delete(q.index, item.id)
+	if len(q.heap) > 0 {
+		// wake up other workers
+		q.notify()
+	}
+	return item.id, true
+}
+
+func (q *fetchQueue) size() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.heap)
+}
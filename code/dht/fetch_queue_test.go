@@ -0,0 +1,54 @@
+package dht
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFetchQueue(t *testing.T) {
+	q := newFetchQueue(2, DropLowest, PriorityWeights{Announce: 1, IP: 2, Query: 0.5, Age: 1})
+	var a, b, c hashType
+	a[0], b[0], c[0] = 1, 2, 3
+	q.push(a, net.ParseIP("1.1.1.1"))
+	q.push(b, net.ParseIP("1.1.1.1"))
+	q.announce(b, net.ParseIP("2.2.2.2"))
+	q.demand(b)
+	// queue is full, c is seen later than a, so c has the lowest priority
+	if dropped := q.push(c, net.ParseIP("1.1.1.1")); len(dropped) != 1 || dropped[0] != c {
+		t.Fatalf("unexpected dropped: %v", dropped)
+	}
+	for _, want := range []hashType{b, a} {
+		id, ok := q.pop()
+		if !ok || id != want {
+			t.Fatalf("unexpected pop: %s, want %s", id.String(), want.String())
+		}
+	}
+	if _, ok := q.pop(); ok {
+		t.Fatal("queue should be empty")
+	}
+}
+
+func TestFetchQueueDemand(t *testing.T) {
+	q := newFetchQueue(2, DropLowest, PriorityWeights{Announce: 1, Query: 1})
+	var a, b hashType
+	a[0], b[0] = 1, 2
+	// queries before announced
+	q.demand(b)
+	q.demand(b)
+	q.push(a, net.ParseIP("1.1.1.1"))
+	q.push(b, net.ParseIP("1.1.1.1"))
+	if q.index[b].queries != 2 || len(q.pending) != 0 {
+		t.Fatalf("pending queries not carried over: %d", q.index[b].queries)
+	}
+	if id, _ := q.pop(); id != b {
+		t.Fatalf("unexpected pop: %s", id.String())
+	}
+	for i := 0; i <= maxPendingQueries; i++ {
+		var id hashType
+		id[0], id[1], id[2] = byte(i), byte(i>>8), 0xff
+		q.demand(id)
+	}
+	if len(q.pending) > maxPendingQueries {
+		t.Fatalf("too many pending queries: %d", len(q.pending))
+	}
+}
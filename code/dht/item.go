@@ -0,0 +1,100 @@
+package dht
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lwch/magic/code/data"
+	"github.com/lwch/magic/code/logging"
+)
+
+var errItemNotFound = errors.New("item not found")
+
+// Get lookup bep_0044 item of target, salt is only used by mutable item,
+// the mutable item with highest seq is returned
+// http://www.bittorrent.org/beps/bep_0044.html
+func (dht *DHT) Get(ctx context.Context, target [20]byte, salt []byte) (*data.Item, error) {
+	var ret *data.Item
+	if item := dht.items.get(target); item != nil {
+		if !item.Mutable() {
+			return item, nil
+		}
+		// the stored mutable item is replaced by higher seq
+		ret = item
+	}
+	lk, err := dht.newLookup(data.TypeGet, target)
+	if err != nil {
+		if ret != nil {
+			return ret, nil
+		}
+		return nil, err
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lk.onResp = func(resp lookupResp) {
+		if resp.item == nil {
+			return
+		}
+		item := *resp.item
+		item.Salt = salt
+		if item.Target() != target || !item.Verify() {
+			logging.Debug("invalid item from %s, target=%x", resp.addr.String(), target)
+			return
+		}
+		if !item.Mutable() {
+			ret = &item
+			// immutable item is never changed
+			cancel()
+			return
+		}
+		if ret == nil || item.Seq > ret.Seq {
+			ret = &item
+		}
+	}
+	lk.run(runCtx)
+	if ret != nil {
+		return ret, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, errItemNotFound
+}
+
+// Put store bep_0044 item to the closest nodes of its target,
+// cas < 0 means no compare-and-swap, returns the count of nodes stored
+// http://www.bittorrent.org/beps/bep_0044.html
+func (dht *DHT) Put(ctx context.Context, item data.Item, cas int64) (int, error) {
+	target := item.Target()
+	lk, err := dht.newLookup(data.TypeGet, target)
+	if err != nil {
+		return 0, err
+	}
+	lk.run(ctx)
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	cnt := 0
+	for _, n := range lk.closest(neighborSize) {
+		if n.state != lookupResponded || len(n.token) == 0 {
+			continue
+		}
+		buf, tx, err := data.PutReq(dht.localID(), n.token, item, cas)
+		if err != nil {
+			return 0, err
+		}
+		err = dht.send(buf, &n.addr)
+		if err != nil {
+			logging.Error("send put packet failed, addr=%s, err=%v", n.addr.String(), err)
+			continue
+		}
+		dht.tx.add(tx, data.TypePut, target, n.id)
+		cnt++
+	}
+	if cnt == 0 {
+		return 0, errNoToken
+	}
+	// store in local node too, so that it can be found by get
+	dht.items.put(item, cas)
+	return cnt, nil
+}
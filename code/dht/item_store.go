@@ -0,0 +1,81 @@
+package dht
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/lwch/magic/code/data"
+)
+
+type storedItem struct {
+	item     data.Item
+	deadline time.Time
+}
+
+// itemStore bep_0044 items by target
+type itemStore struct {
+	sync.Mutex
+	data    map[hashType]*storedItem
+	max     int
+	timeout time.Duration
+}
+
+func newItemStore(max int, timeout time.Duration) *itemStore {
+	return &itemStore{
+		data:    make(map[hashType]*storedItem),
+		max:     max,
+		timeout: timeout,
+	}
+}
+
+func (s *itemStore) get(target hashType) *data.Item {
+	s.Lock()
+	defer s.Unlock()
+	stored := s.data[target]
+	if stored == nil || time.Now().After(stored.deadline) {
+		return nil
+	}
+	item := stored.item
+	return &item
+}
+
+// put store item, returns error code and message when rejected
+// http://www.bittorrent.org/beps/bep_0044.html#mutable-items
+func (s *itemStore) put(item data.Item, cas int64) (int, string) {
+	s.Lock()
+	defer s.Unlock()
+	target := item.Target()
+	deadline := time.Now().Add(s.timeout)
+	stored := s.data[target]
+	if stored != nil && item.Mutable() {
+		if cas >= 0 && cas != stored.item.Seq {
+			return data.ErrCasMismatch, "cas mismatch"
+		}
+		if item.Seq < stored.item.Seq {
+			return data.ErrSeqTooSmall, "sequence number less than current"
+		}
+		if item.Seq == stored.item.Seq && !bytes.Equal(item.V, stored.item.V) {
+			return data.ErrSeqTooSmall, "sequence number less than current"
+		}
+	}
+	if stored == nil && len(s.data) >= s.max {
+		return data.ErrServer, "storage is full"
+	}
+	s.data[target] = &storedItem{
+		item:     item,
+		deadline: deadline,
+	}
+	return 0, ""
+}
+
+func (s *itemStore) clearTimeout() {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for target, stored := range s.data {
+		if now.After(stored.deadline) {
+			delete(s.data, target)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/lwch/magic/code/data"
+)
+
+func TestGetLocalItem(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newItem := func(seq int64) data.Item {
+		item, err := data.NewMutableItem(key, []byte("1:v"), seq, []byte("salt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return item
+	}
+	get := func(dht *DHT, target hashType) int64 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		item, err := dht.Get(ctx, target, []byte("salt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return item.Seq
+	}
+	local := newItem(3)
+	target := local.Target()
+
+	// no nodes in routing table
+	dht := newAnnounceDHT(t, 16898)
+	defer dht.Close()
+	dht.items.put(local, -1)
+	if seq := get(dht, target); seq != 3 {
+		t.Fatalf("unexpected seq: %d", seq)
+	}
+
+	// the highest seq wins
+	lower := newItem(2)
+	n := newFakeNode(t, "", &lower)
+	defer n.conn.Close()
+	dht.tb.add(newNode(dht, data.RandID(), *n.addr()))
+	if seq := get(dht, target); seq != 3 {
+		t.Fatalf("unexpected seq: %d", seq)
+	}
+	higher := newItem(5)
+	n = newFakeNode(t, "", &higher)
+	defer n.conn.Close()
+	dht.tb.add(newNode(dht, data.RandID(), *n.addr()))
+	if seq := get(dht, target); seq != 5 {
+		t.Fatalf("unexpected seq: %d", seq)
+	}
+}
@@ -0,0 +1,337 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/lwch/bencode"
+	"github.com/lwch/magic/code/data"
+	"github.com/lwch/magic/code/logging"
+)
+
+// http://www.bittorrent.org/beps/bep_0005.html
+// https://pdos.csail.mit.edu/~petar/papers/maymounkov-kademlia-lncs.pdf
+const lookupAlpha = 3
+const lookupTimeout = 5 * time.Second
+const maxLookupNodes = 128
+
+var errNoNodes = errors.New("no nodes in routing table")
+
+const (
+	lookupPending = iota
+	lookupQueried
+	lookupResponded
+	lookupFailed
+)
+
+type lookupNode struct {
+	compactNode
+	state int
+	sent  time.Time
+	token string // get_peers token
+}
+
+type lookupResp struct {
+	addr   net.UDPAddr
+	id     hashType
+	token  string
+	values []string
+	item   *data.Item // bep_0044 get response
+	nodes  []compactNode
+	failed bool
+	buf    []byte
+}
+
+// lookup iterative lookup for the k closest nodes of target
+type lookup struct {
+	dht    *DHT
+	target hashType
+	t      data.ReqType
+	nodes  []*lookupNode // sorted by distance
+	seen   map[string]bool
+	chResp chan lookupResp
+	onResp func(lookupResp) // called in lookup goroutine
+}
+
+func (dht *DHT) newLookup(t data.ReqType, target hashType) (*lookup, error) {
+	lk := &lookup{
+		dht:    dht,
+		target: target,
+		t:      t,
+		seen:   make(map[string]bool),
+		chResp: make(chan lookupResp, 64),
+	}
+	seeds := dht.tb.neighbor(target)
+	if dht.tb6 != nil {
+		seeds = append(seeds, dht.tb6.neighbor(target)...)
+	}
+	for _, n := range seeds {
+		lk.addNode(compactNode{id: n.id, addr: n.addr})
+	}
+	// bootstrap nodes are not in strict routing table
+	if dht.tb.strict && len(lk.nodes) < neighborSize {
+		for _, addr := range dht.bootstrap {
+			lk.addNode(compactNode{id: data.RandID(), addr: *addr})
+		}
+	}
+	if len(lk.nodes) == 0 {
+		return nil, errNoNodes
+	}
+	lk.sort()
+	return lk, nil
+}
+
+func (lk *lookup) addNode(n compactNode) {
+	if n.id.equal(lk.dht.localID()) {
+		return
+	}
+	if n.addr.IP.To4() == nil && lk.dht.listen6 == nil {
+		return
+	}
+	key := n.addr.String()
+	if lk.seen[key] {
+		return
+	}
+	lk.seen[key] = true
+	lk.nodes = append(lk.nodes, &lookupNode{compactNode: n})
+}
+
+func (lk *lookup) sort() {
+	sort.Slice(lk.nodes, func(i, j int) bool {
+		return lk.target.closer(lk.nodes[i].id, lk.nodes[j].id)
+	})
+	if len(lk.nodes) <= maxLookupNodes {
+		return
+	}
+	// drop the farthest pending nodes
+	left := lk.nodes[:0]
+	for i, n := range lk.nodes {
+		if i < maxLookupNodes || n.state != lookupPending {
+			left = append(left, n)
+		}
+	}
+	lk.nodes = left
+}
+
+// closest the k closest nodes which not failed
+func (lk *lookup) closest(k int) []*lookupNode {
+	ret := make([]*lookupNode, 0, k)
+	for _, n := range lk.nodes {
+		if len(ret) >= k {
+			break
+		}
+		if n.state == lookupFailed {
+			continue
+		}
+		ret = append(ret, n)
+	}
+	return ret
+}
+
+func (lk *lookup) find(addr net.UDPAddr) *lookupNode {
+	key := addr.String()
+	for _, n := range lk.nodes {
+		if n.addr.String() == key {
+			return n
+		}
+	}
+	return nil
+}
+
+func (lk *lookup) run(ctx context.Context) {
+	tk := time.NewTicker(time.Second / 10)
+	defer tk.Stop()
+	for {
+		if !lk.next() {
+			return
+		}
+		select {
+		case resp := <-lk.chResp:
+			lk.handle(resp)
+		case <-tk.C:
+			lk.checkTimeout()
+		case <-ctx.Done():
+			return
+		case <-lk.dht.ctx.Done():
+			return
+		}
+	}
+}
+
+// next send requests to the closest pending nodes,
+// returns false when the k closest nodes are all responded
+func (lk *lookup) next() bool {
+	inflight := 0
+	var pending []*lookupNode
+	for _, n := range lk.closest(neighborSize) {
+		switch n.state {
+		case lookupQueried:
+			inflight++
+		case lookupPending:
+			pending = append(pending, n)
+		}
+	}
+	for _, n := range pending {
+		if inflight >= lookupAlpha {
+			break
+		}
+		if lk.send(n) {
+			inflight++
+		}
+	}
+	return inflight > 0
+}
+
+func (lk *lookup) send(n *lookupNode) bool {
+	var buf []byte
+	var tx string
+	var err error
+	switch lk.t {
+	case data.TypeFindNode:
+		buf, tx, err = data.FindReq(lk.dht.localID(), lk.target, lk.dht.want())
+	case data.TypeGet:
+		buf, tx, err = data.GetReq(lk.dht.localID(), lk.target, -1, lk.dht.want())
+	default:
+		buf, tx, err = data.GetPeers(lk.dht.localID(), lk.target, lk.dht.want())
+	}
+	if err != nil {
+		logging.Error("build %s packet failed, addr=%s, err=%v", lk.t, n.addr.String(), err)
+		n.state = lookupFailed
+		return false
+	}
+	lk.dht.tx.addLookup(tx, lk.t, lk)
+	err = lk.dht.send(buf, &n.addr)
+	if err != nil {
+		n.state = lookupFailed
+		return false
+	}
+	n.state = lookupQueried
+	n.sent = time.Now()
+	return true
+}
+
+func (lk *lookup) checkTimeout() {
+	for _, n := range lk.nodes {
+		if n.state == lookupQueried && time.Since(n.sent) >= lookupTimeout {
+			n.state = lookupFailed
+		}
+	}
+}
+
+func (lk *lookup) handle(resp lookupResp) {
+	n := lk.find(resp.addr)
+	if n == nil || n.state != lookupQueried {
+		return
+	}
+	if resp.failed {
+		n.state = lookupFailed
+		return
+	}
+	n.state = lookupResponded
+	n.id = resp.id
+	n.token = resp.token
+	for _, node := range resp.nodes {
+		lk.addNode(node)
+	}
+	lk.sort()
+	if lk.onResp != nil {
+		lk.onResp(resp)
+	}
+}
+
+// recv called in handler goroutine when lookup response received
+func (lk *lookup) recv(addr net.UDPAddr, buf []byte) {
+	resp := lookupResp{addr: addr, buf: buf}
+	var nodes, nodes6 string
+	if lk.t == data.TypeGet {
+		rep, err := data.ParseGetRep(buf)
+		if err != nil {
+			resp.failed = true
+		} else {
+			resp.id = rep.ID
+			resp.token = rep.Token
+			resp.item = rep.Item
+			nodes, nodes6 = rep.Nodes, rep.Nodes6
+		}
+	} else {
+		var rep struct {
+			data.Hdr
+			Response struct {
+				ID     [20]byte `bencode:"id"`
+				Token  string   `bencode:"token"`
+				Nodes  string   `bencode:"nodes"`
+				Nodes6 string   `bencode:"nodes6"`
+				Values []string `bencode:"values"`
+			} `bencode:"r"`
+		}
+		err := bencode.Decode(buf, &rep)
+		if err != nil {
+			resp.failed = true
+		} else {
+			resp.id = rep.Response.ID
+			resp.token = rep.Response.Token
+			resp.values = rep.Response.Values
+			nodes, nodes6 = rep.Response.Nodes, rep.Response.Nodes6
+		}
+	}
+	if resp.id == emptyHash {
+		resp.failed = true
+	}
+	if !resp.failed {
+		resp.nodes = append(decodeNodes(nodes, net.IPv4len),
+			decodeNodes(nodes6, net.IPv6len)...)
+		// the responded node is alive
+		tb := lk.dht.tableFor(addr.IP)
+		if tb.findID(resp.id) == nil {
+			tb.add(newNode(lk.dht, resp.id, addr))
+		}
+	}
+	select {
+	case lk.chResp <- resp:
+	default:
+	}
+}
+
+// fail called in handler goroutine when lookup request failed
+func (lk *lookup) fail(addr net.UDPAddr) {
+	select {
+	case lk.chResp <- lookupResp{addr: addr, failed: true}:
+	default:
+	}
+}
+
+// GetPeers lookup peers of info_hash, the channel is closed when lookup finished
+func (dht *DHT) GetPeers(ctx context.Context, hash [20]byte) (<-chan net.Addr, error) {
+	lk, err := dht.newLookup(data.TypeGetPeers, hash)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan net.Addr, 100)
+	seen := make(map[string]bool)
+	lk.onResp = func(resp lookupResp) {
+		for _, value := range resp.values {
+			ip, port := parseCompactAddr(value)
+			if ip == nil || port == 0 {
+				continue
+			}
+			addr := &net.TCPAddr{IP: ip, Port: int(port)}
+			if seen[addr.String()] {
+				continue
+			}
+			seen[addr.String()] = true
+			select {
+			case ch <- addr:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+	go func() {
+		defer close(ch)
+		lk.run(ctx)
+	}()
+	return ch, nil
+}
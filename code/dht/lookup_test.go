@@ -0,0 +1,126 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lwch/bencode"
+	"github.com/lwch/magic/code/data"
+)
+
+// readTestRequest read request sent to remote, returns the transaction
+func readTestRequest(t *testing.T, remote *net.UDPConn, want data.ReqType) string {
+	buf := readTestPacket(t, remote, time.Second)
+	pkt, err := data.ParsePacket(buf)
+	if err != nil || pkt.Query != want {
+		t.Fatalf("unexpected request: %q", buf)
+	}
+	return pkt.Transaction
+}
+
+func TestLookup(t *testing.T) {
+	dht, remote := newTestDHT(t)
+	defer closeTestDHT(dht, remote)
+	target := hashType(data.RandID())
+	n := newTestNode(dht, remote)
+	n.id = target
+	n.id[19] ^= 0xff
+	dht.tb.add(n)
+	lk, err := dht.newLookup(data.TypeGetPeers, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lk.next() {
+		t.Fatal("no request sent")
+	}
+	readTestRequest(t, remote, data.TypeGetPeers)
+	// response with a closer node and a farther node
+	closer, farther := target, target
+	closer[19] ^= 1
+	farther[0] ^= 0xff
+	nodes := []*node{
+		newNode(dht, farther, net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}),
+		newNode(dht, closer, net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}),
+	}
+	var values []string
+	lk.onResp = func(resp lookupResp) {
+		values = resp.values
+	}
+	rep, err := data.GetPeersNotFound("aa", n.id, "tk", string(compactNodes(nodes, net.IPv4len)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lk.recv(n.addr, rep)
+	lk.handle(<-lk.chResp)
+	if len(lk.nodes) != 3 || lk.nodes[0].id != closer || lk.nodes[2].id != farther {
+		t.Fatal("nodes in response are not sorted")
+	}
+	if lk.nodes[1].state != lookupResponded || lk.nodes[1].token != "tk" || values != nil {
+		t.Fatal("unexpected response state")
+	}
+	// duplicated node is ignored
+	lk.addNode(compactNode{id: closer, addr: nodes[1].addr})
+	if len(lk.nodes) != 3 {
+		t.Fatal("duplicated node is added")
+	}
+	if !lk.next() || lk.nodes[0].state != lookupQueried || lk.nodes[2].state != lookupQueried {
+		t.Fatal("new nodes are not queried")
+	}
+	for _, n := range lk.nodes {
+		n.sent = time.Now().Add(-lookupTimeout)
+	}
+	lk.checkTimeout()
+	if lk.next() {
+		t.Fatal("lookup is not finished")
+	}
+	if closest := lk.closest(neighborSize); len(closest) != 1 || closest[0].id != n.id {
+		t.Fatal("failed nodes are returned")
+	}
+}
+
+func TestGetPeers(t *testing.T) {
+	dht, remote := newTestDHT(t)
+	defer closeTestDHT(dht, remote)
+	if _, err := dht.GetPeers(context.Background(), data.RandID()); err != errNoNodes {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	n := newTestNode(dht, remote)
+	dht.tb.add(n)
+	hash := data.RandID()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ch, err := dht.GetPeers(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := readTestRequest(t, remote, data.TypeGetPeers)
+	peer := peerInfo{ip: net.IPv4(1, 2, 3, 4), port: 6881}
+	// the same peer is returned once
+	rep, err := data.GetPeersFound(tx, n.id, "tk", []string{peer.compact(), peer.compact()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dht.handleData(&n.addr, rep)
+	var peers []string
+	for addr := range ch {
+		peers = append(peers, addr.String())
+	}
+	if len(peers) != 1 || peers[0] != "1.2.3.4:6881" {
+		t.Fatalf("unexpected peers: %v", peers)
+	}
+}
+
+func TestLookupRecvInvalid(t *testing.T) {
+	dht, remote := newTestDHT(t)
+	defer closeTestDHT(dht, remote)
+	lk := &lookup{dht: dht, t: data.TypeGetPeers, chResp: make(chan lookupResp, 1)}
+	var rep data.GetPeersNotFoundResponse
+	buf, _ := bencode.Encode(rep)
+	// response without id
+	lk.recv(net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, buf)
+	if resp := <-lk.chResp; !resp.failed || dht.tb.count() != 0 {
+		t.Fatal("invalid response is accepted")
+	}
+}
@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+var errInvalidMagnet = errors.New("invalid magnet link")
+
+// Magnet magnet link
+// http://www.bittorrent.org/beps/bep_0009.html#magnet-uri-format
+type Magnet struct {
+	Hash     [20]byte // v1 info_hash or truncated v2 info_hash
+	HashV2   string   // hex sha256 info_hash, bep_0052
+	Name     string
+	Trackers []string
+	Peers    []string // host:port
+}
+
+// ParseHash parse info_hash in hex or base32 encoding
+func ParseHash(str string) ([20]byte, error) {
+	var ret [20]byte
+	var buf []byte
+	var err error
+	switch len(str) {
+	case 40:
+		buf, err = hex.DecodeString(str)
+	case 32:
+		buf, err = base32.StdEncoding.DecodeString(strings.ToUpper(str))
+	default:
+		return ret, errInvalidHash
+	}
+	if err != nil {
+		return ret, errInvalidHash
+	}
+	copy(ret[:], buf)
+	return ret, nil
+}
+
+// ParseMagnet parse magnet link, xt supports urn:btih and urn:btmh
+// http://www.bittorrent.org/beps/bep_0052.html#magnet-links
+func ParseMagnet(link string) (*Magnet, error) {
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme != "magnet" {
+		return nil, errInvalidMagnet
+	}
+	args, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, errInvalidMagnet
+	}
+	var ret Magnet
+	var found bool
+	for key, values := range args {
+		// xt.1, xt.2 ... are the same as xt
+		if key != "xt" && !strings.HasPrefix(key, "xt.") {
+			continue
+		}
+		for _, xt := range values {
+			switch {
+			case strings.HasPrefix(xt, "urn:btih:"):
+				hash, err := ParseHash(xt[len("urn:btih:"):])
+				if err != nil {
+					return nil, err
+				}
+				ret.Hash = hash
+				found = true
+			case strings.HasPrefix(xt, "urn:btmh:1220"):
+				// multihash of sha256
+				hash, err := hex.DecodeString(xt[len("urn:btmh:1220"):])
+				if err != nil || len(hash) != 32 {
+					return nil, errInvalidHash
+				}
+				ret.HashV2 = hex.EncodeToString(hash)
+				if !found {
+					copy(ret.Hash[:], hash)
+				}
+			}
+		}
+	}
+	if !found && len(ret.HashV2) == 0 {
+		return nil, errInvalidMagnet
+	}
+	ret.Name = args.Get("dn")
+	ret.Trackers = args["tr"]
+	ret.Peers = args["x.pe"]
+	return &ret, nil
+}
+
+// String build magnet link, the v1 info_hash is omitted for v2 only torrent
+func (m Magnet) String() string {
+	var args []string
+	v2Only := false
+	if len(m.HashV2) > 0 {
+		hash, _ := hex.DecodeString(m.HashV2)
+		v2Only = len(hash) >= 20 && string(hash[:20]) == string(m.Hash[:])
+	}
+	if !v2Only {
+		args = append(args, "xt=urn:btih:"+hex.EncodeToString(m.Hash[:]))
+	}
+	if len(m.HashV2) > 0 {
+		args = append(args, "xt=urn:btmh:1220"+m.HashV2)
+	}
+	if len(m.Name) > 0 {
+		args = append(args, "dn="+url.QueryEscape(m.Name))
+	}
+	for _, tr := range m.Trackers {
+		args = append(args, "tr="+url.QueryEscape(tr))
+	}
+	for _, pe := range m.Peers {
+		args = append(args, "x.pe="+url.QueryEscape(pe))
+	}
+	return "magnet:?" + strings.Join(args, "&")
+}
+
+// magnetOf magnet link of meta info without trackers
+func magnetOf(info *MetaInfo) string {
+	m := Magnet{HashV2: info.HashV2, Name: info.Name}
+	hash, _ := hex.DecodeString(info.Hash)
+	copy(m.Hash[:], hash)
+	return m.String()
+}
@@ -0,0 +1,53 @@
+package dht
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	hash := "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+	m, err := ParseMagnet("magnet:?xt=urn:btih:" + strings.ToUpper(hash) +
+		"&dn=a+b&tr=udp%3A%2F%2Ft1&tr=udp://t2&x.pe=1.2.3.4:5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(m.Hash[:]) != hash || m.Name != "a b" ||
+		len(m.Trackers) != 2 || m.Trackers[0] != "udp://t1" ||
+		len(m.Peers) != 1 || m.Peers[0] != "1.2.3.4:5" {
+		t.Fatalf("unexpected magnet: %+v", m)
+	}
+	if m.String() != "magnet:?xt=urn:btih:"+hash+"&dn=a+b&tr=udp%3A%2F%2Ft1&tr=udp%3A%2F%2Ft2&x.pe=1.2.3.4%3A5" {
+		t.Fatalf("unexpected link: %s", m.String())
+	}
+	// base32
+	b32, err := ParseMagnet("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b32.Hash != m.Hash {
+		t.Fatalf("unexpected base32 hash: %x", b32.Hash)
+	}
+	// v2 only
+	v2 := strings.Repeat("ab", 32)
+	m, err = ParseMagnet("magnet:?xt=urn:btmh:1220" + v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.HashV2 != v2 || hex.EncodeToString(m.Hash[:]) != v2[:40] {
+		t.Fatalf("unexpected v2 magnet: %+v", m)
+	}
+	if m.String() != "magnet:?xt=urn:btmh:1220"+v2 {
+		t.Fatalf("unexpected v2 link: %s", m.String())
+	}
+	for _, link := range []string{
+		"http://a?xt=urn:btih:" + hash,
+		"magnet:?dn=a",
+		"magnet:?xt=urn:btih:123",
+	} {
+		if _, err := ParseMagnet(link); err == nil {
+			t.Fatalf("invalid link %s parsed", link)
+		}
+	}
+}
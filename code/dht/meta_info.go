@@ -0,0 +1,219 @@
+package dht
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/lwch/magic/code/data"
+)
+
+var errInvalidInfo = errors.New("invalid info dictionary")
+
+// MetaFile file info
+type MetaFile struct {
+	Path    []string `json:"path"`
+	Length  int      `json:"length"`
+	Attr    string   `json:"attr,omitempty"`    // http://www.bittorrent.org/beps/bep_0047.html
+	Symlink []string `json:"symlink,omitempty"` // symlink path when attr contains l
+	MD5     string   `json:"md5sum,omitempty"`
+	Root    string   `json:"pieces_root,omitempty"` // merkle root of v2 file, bep_0052
+}
+
+// IsPad is padding file
+// http://www.bittorrent.org/beps/bep_0047.html
+func (f MetaFile) IsPad() bool {
+	return strings.Contains(f.Attr, "p")
+}
+
+// MetaInfo meta info
+type MetaInfo struct {
+	Hash        string     `json:"hash"`              // v1 info_hash, truncated v2 info_hash for v2 only torrent
+	HashV2      string     `json:"hash_v2,omitempty"` // sha256 info_hash, bep_0052
+	Version     int        `json:"meta_version,omitempty"`
+	Peer        string     `json:"peer"`
+	Name        string     `json:"name"`
+	Length      int        `json:"length"` // total length of files for v2 only torrent
+	MetaLength  int        `json:"meta_length"`
+	PieceLength int        `json:"piece_length"`
+	Pieces      int        `json:"pieces"` // count of pieces, the sum of each file for v2 only torrent
+	Private     bool       `json:"private,omitempty"`
+	Source      string     `json:"source,omitempty"`
+	Attr        string     `json:"attr,omitempty"`
+	Symlink     []string   `json:"symlink,omitempty"`
+	MD5         string     `json:"md5sum,omitempty"`
+	Files       []MetaFile `json:"files,omitempty"`
+	Magnet      string     `json:"magnet"`
+	Raw         []byte     `json:"-"` // verified info dictionary
+}
+
+func dictString(dict map[string]interface{}, key string) string {
+	str, _ := dict[key].(string)
+	return str
+}
+
+func dictInt(dict map[string]interface{}, key string) int {
+	n, _ := dict[key].(int64)
+	return int(n)
+}
+
+func dictStrings(dict map[string]interface{}, key string) []string {
+	list, _ := dict[key].([]interface{})
+	if list == nil {
+		return nil
+	}
+	ret := make([]string, 0, len(list))
+	for _, v := range list {
+		str, ok := v.(string)
+		if !ok {
+			return nil
+		}
+		ret = append(ret, str)
+	}
+	return ret
+}
+
+// dictUTF8 the utf-8 version of key when present
+func dictUTF8(dict map[string]interface{}, key string) string {
+	if str := dictString(dict, key+".utf-8"); len(str) > 0 {
+		return str
+	}
+	return dictString(dict, key)
+}
+
+// verifyInfo check the info dictionary by info_hash, the info_hash
+// may be the sha1 or the sha256 truncated to 20 bytes
+// http://www.bittorrent.org/beps/bep_0052.html#infohash
+func verifyInfo(id hashType, raw []byte) bool {
+	if sha1.Sum(raw) == id {
+		return true
+	}
+	hash := sha256.Sum256(raw)
+	var truncated hashType
+	copy(truncated[:], hash[:])
+	return truncated == id
+}
+
+// parseFileTree parse v2 file tree recursively, the files are sorted by path
+// http://www.bittorrent.org/beps/bep_0052.html#info-dictionary
+func parseFileTree(tree map[string]interface{}, path []string) ([]MetaFile, error) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var ret []MetaFile
+	for _, name := range names {
+		node, ok := tree[name].(map[string]interface{})
+		if !ok {
+			return nil, errInvalidInfo
+		}
+		if len(name) == 0 {
+			// file node
+			ret = append(ret, MetaFile{
+				Path:   path,
+				Length: dictInt(node, "length"),
+				Attr:   dictString(node, "attr"),
+				Root:   hex.EncodeToString([]byte(dictString(node, "pieces root"))),
+			})
+			continue
+		}
+		sub := make([]string, len(path), len(path)+1)
+		copy(sub, path)
+		files, err := parseFileTree(node, append(sub, name))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, files...)
+	}
+	return ret, nil
+}
+
+// parseMetaInfo parse info dictionary, the padding files are dropped when dropPad is set
+// http://www.bittorrent.org/beps/bep_0003.html#info-dictionary
+func parseMetaInfo(r resReq, raw []byte, dropPad bool) (*MetaInfo, error) {
+	v, err := data.Decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	info, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errInvalidInfo
+	}
+	ret := &MetaInfo{
+		Hash:        r.id.String(),
+		Peer:        r.addr(),
+		Name:        dictUTF8(info, "name"),
+		Length:      dictInt(info, "length"),
+		MetaLength:  len(raw),
+		PieceLength: dictInt(info, "piece length"),
+		Pieces:      len(dictString(info, "pieces")) / 20,
+		Private:     dictInt(info, "private") == 1,
+		Source:      dictString(info, "source"),
+		Attr:        dictString(info, "attr"),
+		Symlink:     dictStrings(info, "symlink path"),
+		MD5:         dictString(info, "md5sum"),
+		Raw:         raw,
+	}
+	ret.Version = dictInt(info, "meta version")
+	if ret.Version == 2 {
+		hash := sha256.Sum256(raw)
+		ret.HashV2 = hex.EncodeToString(hash[:])
+		// hybrid torrent contains pieces for v1
+		if _, ok := info["pieces"]; ok {
+			hash := sha1.Sum(raw)
+			ret.Hash = hex.EncodeToString(hash[:])
+		}
+	}
+	files, _ := info["files"].([]interface{})
+	if tree, ok := info["file tree"].(map[string]interface{}); ok && len(files) == 0 && ret.Version == 2 {
+		list, err := parseFileTree(tree, nil)
+		if err != nil {
+			return nil, err
+		}
+		// v2 only torrent has no length and pieces of v1, each file is aligned to piece
+		// http://www.bittorrent.org/beps/bep_0052.html#info-dictionary
+		if _, ok := info["pieces"]; !ok {
+			for _, mf := range list {
+				ret.Length += mf.Length
+				if ret.PieceLength > 0 {
+					ret.Pieces += (mf.Length + ret.PieceLength - 1) / ret.PieceLength
+				}
+			}
+		}
+		for _, mf := range list {
+			if dropPad && mf.IsPad() {
+				continue
+			}
+			ret.Files = append(ret.Files, mf)
+		}
+		ret.Magnet = magnetOf(ret)
+		return ret, nil
+	}
+	for _, f := range files {
+		file, ok := f.(map[string]interface{})
+		if !ok {
+			return nil, errInvalidInfo
+		}
+		path := dictStrings(file, "path.utf-8")
+		if len(path) == 0 {
+			path = dictStrings(file, "path")
+		}
+		mf := MetaFile{
+			Path:    path,
+			Length:  dictInt(file, "length"),
+			Attr:    dictString(file, "attr"),
+			Symlink: dictStrings(file, "symlink path"),
+			MD5:     dictString(file, "md5sum"),
+		}
+		if dropPad && mf.IsPad() {
+			continue
+		}
+		ret.Files = append(ret.Files, mf)
+	}
+	ret.Magnet = magnetOf(ret)
+	return ret, nil
+}
@@ -0,0 +1,73 @@
+package dht
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestParseMetaInfo(t *testing.T) {
+	raw := "d5:filesl" +
+		"d6:lengthi10e6:md5sum32:" + strings.Repeat("0", 32) + "4:pathl1:ae10:path.utf-8l3:a.bee" +
+		"d4:attr1:p6:lengthi6e4:pathl4:.pad1:6ee" +
+		"d4:attr1:l6:lengthi0e4:pathl1:ce12:symlink pathl1:aee" +
+		"e4:name4:test10:name.utf-84:utf812:piece lengthi16384e6:pieces40:" + strings.Repeat("x", 40) +
+		"7:privatei1e6:source3:srce"
+	info, err := parseMetaInfo(resReq{}, []byte(raw), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "utf8" || info.PieceLength != 16384 || info.Pieces != 2 ||
+		!info.Private || info.Source != "src" {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+	if len(info.Files) != 3 || !info.Files[1].IsPad() ||
+		info.Files[0].Path[0] != "a.b" || len(info.Files[0].MD5) != 32 ||
+		info.Files[2].Symlink[0] != "a" {
+		t.Fatalf("unexpected files: %+v", info.Files)
+	}
+	info, err = parseMetaInfo(resReq{}, []byte(raw), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Files) != 2 {
+		t.Fatalf("padding file is not dropped: %+v", info.Files)
+	}
+}
+
+func TestParseMetaInfoV2(t *testing.T) {
+	root := strings.Repeat("r", 32)
+	raw := []byte("d9:file treed" +
+		"3:dird1:ad0:d6:lengthi1e11:pieces root32:" + root + "eee" +
+		"4:filed0:d6:lengthi2eee" +
+		"e12:meta versioni2e4:name4:test12:piece lengthi16384ee")
+	hash := sha256.Sum256(raw)
+	var id hashType
+	copy(id[:], hash[:])
+	if !verifyInfo(id, raw) {
+		t.Fatal("verify truncated v2 info_hash failed")
+	}
+	info, err := parseMetaInfo(resReq{id: id}, raw, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != 2 || info.HashV2 != hex.EncodeToString(hash[:]) || info.Hash != id.String() ||
+		info.Length != 3 || info.Pieces != 2 {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+	if len(info.Files) != 2 ||
+		strings.Join(info.Files[0].Path, "/") != "dir/a" || info.Files[0].Root != hex.EncodeToString([]byte(root)) ||
+		strings.Join(info.Files[1].Path, "/") != "file" || info.Files[1].Length != 2 {
+		t.Fatalf("unexpected files: %+v", info.Files)
+	}
+}
+
+func TestParseMetaInfoDepth(t *testing.T) {
+	// verified info dictionary from attacker may be deeply nested
+	n := maxMetaSize / 2
+	raw := "d4:name" + strings.Repeat("l", n) + strings.Repeat("e", n) + "e"
+	if _, err := parseMetaInfo(resReq{}, []byte(raw), false); err == nil {
+		t.Fatal("deeply nested info dictionary is parsed")
+	}
+}
@@ -0,0 +1,112 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// FailedHash info_hash which failed to fetch metadata
+type FailedHash struct {
+	Hash      string    `json:"hash"`
+	Reason    string    `json:"reason"`
+	Attempts  int       `json:"attempts"`
+	Failed    time.Time `json:"failed"`     // last failed time
+	NextRetry time.Time `json:"next_retry"` // skipped before this time
+}
+
+// negCache failed info_hash with exponential backoff
+type negCache struct {
+	sync.Mutex
+	data       map[hashType]*FailedHash
+	max        int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func newNegCache(max int, backoff, maxBackoff time.Duration) *negCache {
+	return &negCache{
+		data:       make(map[hashType]*FailedHash),
+		max:        max,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+	}
+}
+
+// fail record failed info_hash, the backoff is doubled by each attempt
+func (c *negCache) fail(hash hashType, reason string) {
+	c.Lock()
+	defer c.Unlock()
+	item, ok := c.data[hash]
+	if !ok {
+		if len(c.data) >= c.max {
+			return
+		}
+		item = &FailedHash{Hash: hash.String()}
+		c.data[hash] = item
+	}
+	item.Reason = reason
+	item.Attempts++
+	item.Failed = time.Now()
+	backoff := c.backoff
+	for i := 1; i < item.Attempts && backoff < c.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > c.maxBackoff {
+		backoff = c.maxBackoff
+	}
+	item.NextRetry = item.Failed.Add(backoff)
+}
+
+// blocked info_hash is in backoff
+func (c *negCache) blocked(hash hashType) bool {
+	c.Lock()
+	defer c.Unlock()
+	item, ok := c.data[hash]
+	return ok && time.Now().Before(item.NextRetry)
+}
+
+func (c *negCache) remove(hash hashType) {
+	c.Lock()
+	delete(c.data, hash)
+	c.Unlock()
+}
+
+// list all failed info_hash sorted by last failed time
+func (c *negCache) list() []FailedHash {
+	c.Lock()
+	ret := make([]FailedHash, 0, len(c.data))
+	for _, item := range c.data {
+		ret = append(ret, *item)
+	}
+	c.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Failed.Before(ret[j].Failed)
+	})
+	return ret
+}
+
+// clear remove info_hash from cache, all are removed when hashes is empty
+func (c *negCache) clear(hashes ...[20]byte) {
+	c.Lock()
+	defer c.Unlock()
+	if len(hashes) == 0 {
+		c.data = make(map[hashType]*FailedHash)
+		return
+	}
+	for _, hash := range hashes {
+		delete(c.data, hash)
+	}
+}
+
+// clearTimeout forget info_hash which not failed again in max backoff after retry
+func (c *negCache) clearTimeout() {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	for hash, item := range c.data {
+		if now.Sub(item.NextRetry) >= c.maxBackoff {
+			delete(c.data, hash)
+		}
+	}
+}
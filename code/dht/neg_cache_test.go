@@ -0,0 +1,29 @@
+package dht
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNegCache(t *testing.T) {
+	c := newNegCache(10, time.Minute, 5*time.Minute)
+	var hash hashType
+	hash[0] = 1
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute} {
+		c.fail(hash, "timeout")
+		item := c.list()[0]
+		if item.Attempts != i+1 {
+			t.Fatalf("unexpected attempts: %d", item.Attempts)
+		}
+		if backoff := item.NextRetry.Sub(item.Failed); backoff != want {
+			t.Fatalf("unexpected backoff at attempt %d: %s", item.Attempts, backoff)
+		}
+	}
+	if !c.blocked(hash) {
+		t.Fatal("hash should be blocked")
+	}
+	c.clear(hash)
+	if c.blocked(hash) || len(c.list()) != 0 {
+		t.Fatal("hash should be cleared")
+	}
+}
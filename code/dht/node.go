@@ -21,12 +21,21 @@ type node struct {
 	id          hashType
 	addr        net.UDPAddr
 	updated     time.Time
+	pinged      time.Time // last ping time in strict mode
+	failed      int       // count of error responses since last good response
 	chPong      chan struct{}
 	isBootstrap bool
 }
 
-func newNode(dht *DHT, id hashType, addr net.UDPAddr) *node {
+// getNode get node from pool with all fields reset
+func getNode(dht *DHT) *node {
 	n := dht.nodePool.Get().(*node)
+	*n = node{dht: dht}
+	return n
+}
+
+func newNode(dht *DHT, id hashType, addr net.UDPAddr) *node {
+	n := getNode(dht)
 	n.id = id
 	n.addr = addr
 	n.updated = time.Now()
@@ -35,7 +44,7 @@ func newNode(dht *DHT, id hashType, addr net.UDPAddr) *node {
 }
 
 func newBootstrapNode(dht *DHT, addr net.UDPAddr) *node {
-	n := dht.nodePool.Get().(*node)
+	n := getNode(dht)
 	n.id = data.RandID()
 	n.addr = addr
 	n.updated = time.Now()
@@ -55,12 +64,12 @@ func (n *node) sendDiscovery(fn func() [20]byte) {
 	} else {
 		rand.Read(next[:])
 	}
-	pkt, tx, err := data.FindReq(n.dht.local, next)
+	pkt, tx, err := data.FindReq(n.dht.localID(), next, n.dht.want())
 	if err != nil {
 		logging.Error("build find_node packet failed" + n.errInfo(err))
 		return
 	}
-	_, err = n.dht.listen.WriteTo(pkt, &n.addr)
+	err = n.dht.send(pkt, &n.addr)
 	if err != nil {
 		logging.Error("send find_node packet failed" + n.errInfo(err))
 		return
@@ -69,7 +78,7 @@ func (n *node) sendDiscovery(fn func() [20]byte) {
 }
 
 func (n *node) sendPing(queue *initQueue) string {
-	buf, tx, err := data.PingReq(n.dht.local)
+	buf, tx, err := data.PingReq(n.dht.localID())
 	if err != nil {
 		logging.Error("build get_peers packet failed" + n.errInfo(err))
 		return ""
@@ -77,7 +86,7 @@ func (n *node) sendPing(queue *initQueue) string {
 	if queue != nil {
 		queue.push(tx, n)
 	}
-	_, err = n.dht.listen.WriteTo(buf, &n.addr)
+	err = n.dht.send(buf, &n.addr)
 	if err != nil {
 		logging.Error("send get_peers packet failed" + n.errInfo(err))
 		return ""
@@ -86,12 +95,12 @@ func (n *node) sendPing(queue *initQueue) string {
 }
 
 func (n *node) sendGet(hash hashType) {
-	buf, tx, err := data.GetPeers(n.dht.local, hash)
+	buf, tx, err := data.GetPeers(n.dht.localID(), hash, n.dht.want())
 	if err != nil {
 		logging.Error("build get_peers packet failed" + n.errInfo(err))
 		return
 	}
-	_, err = n.dht.listen.WriteTo(buf, &n.addr)
+	err = n.dht.send(buf, &n.addr)
 	if err != nil {
 		logging.Error("send get_peers packet failed" + n.errInfo(err))
 		return
@@ -99,38 +108,54 @@ func (n *node) sendGet(hash hashType) {
 	n.dht.tx.add(tx, data.TypeGetPeers, hash, emptyHash)
 }
 
-func (n *node) onRecv(buf []byte) {
-	n.updated = time.Now()
-	var hdr data.Hdr
-	err := bencode.Decode(buf, &hdr)
-	if err != nil {
-		// TODO: log
-		return
+// questionable no activity in 15 minutes and not pinged yet
+// http://www.bittorrent.org/beps/bep_0005.html#routing-table
+func (n *node) questionable() bool {
+	return !n.isBootstrap &&
+		time.Since(n.updated) >= strictNodeTimeout &&
+		!n.pinged.After(n.updated)
+}
+
+// bad failed multiple times or not responded to ping
+func (n *node) bad() bool {
+	if n.isBootstrap {
+		return false
+	}
+	if n.failed >= maxNodeFailed {
+		return true
 	}
+	return n.pinged.After(n.updated) && time.Since(n.pinged) >= strictPingTimeout
+}
+
+func (n *node) ping() {
+	tx := n.sendPing(nil)
+	n.dht.tx.add(tx, data.TypePing, emptyHash, emptyHash)
+	n.pinged = time.Now()
+}
+
+func (n *node) onRecv(buf []byte, hdr data.Packet) {
+	n.updated = time.Now()
+	n.dht.tableFor(n.addr.IP).touch(n)
 	switch {
 	case hdr.IsRequest():
-		n.handleRequest(buf)
+		n.handleRequest(buf, hdr)
 	case hdr.IsResponse():
 		n.handleResponse(buf, hdr.Transaction)
+	case hdr.IsError():
+		n.handleError(buf, hdr.Transaction)
 	}
 }
 
-func (n *node) handleRequest(buf []byte) {
-	var req struct {
-		Data struct {
-			ID [20]byte `bencode:"id"`
-		} `bencode:"a"`
-	}
-	err := bencode.Decode(buf, &req)
-	if err != nil {
-		logging.Error("decode request failed" + n.errInfo(err))
+func (n *node) handleRequest(buf []byte, hdr data.Packet) {
+	if hdr.ID == emptyHash {
+		n.sendError(hdr.Transaction, data.ErrProtocol, "missing id")
 		return
 	}
-	if !n.id.equal(req.Data.ID) {
-		n.dht.tb.remove(n)
+	if !n.id.equal(hdr.ID) {
+		n.dht.tableFor(n.addr.IP).remove(n)
 		return
 	}
-	switch data.ParseReqType(buf) {
+	switch hdr.Query {
 	case data.TypePing:
 		n.onPing(buf)
 	case data.TypeFindNode:
@@ -139,6 +164,14 @@ func (n *node) handleRequest(buf []byte) {
 		n.onGetPeers(buf)
 	case data.TypeAnnouncePeer:
 		n.onAnnouncePeer(buf)
+	case data.TypeSampleInfohashes:
+		n.onSampleInfohashes(buf)
+	case data.TypeGet:
+		n.onGet(buf)
+	case data.TypePut:
+		n.onPut(buf)
+	default:
+		n.sendError(hdr.Transaction, data.ErrMethodUnknown, "method unknown")
 	}
 }
 
@@ -147,6 +180,12 @@ func (n *node) handleResponse(buf []byte, tx string) {
 	if txr == nil {
 		return
 	}
+	n.failed = 0
+	n.dht.voteResp(n.addr, buf)
+	if txr.lk != nil {
+		txr.lk.recv(n.addr, buf)
+		return
+	}
 	switch txr.t {
 	case data.TypePing:
 		n.updated = time.Now()
@@ -158,7 +197,28 @@ func (n *node) handleResponse(buf []byte, tx string) {
 		n.onFindNodeResp(buf)
 	case data.TypeGetPeers:
 		n.onGetPeersResp(buf, txr.hash)
+	case data.TypeSampleInfohashes:
+		n.onSampleInfohashesResp(buf)
+	}
+}
+
+// http://www.bittorrent.org/beps/bep_0005.html#errors
+func (n *node) handleError(buf []byte, tx string) {
+	txr := n.dht.tx.find(tx)
+	if txr == nil {
+		return
+	}
+	n.failed++
+	if txr.lk != nil {
+		txr.lk.fail(n.addr)
+	}
+	var rep data.ErrorResponse
+	err := bencode.Decode(buf, &rep)
+	if err != nil {
+		logging.Error("decode error response failed" + n.errInfo(err))
+		return
 	}
+	logging.Debug("error response: code=%d, msg=%s"+n.info(), rep.Code(), rep.Message())
 }
 
 func (n *node) errInfo(err error) string {
@@ -0,0 +1,68 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lwch/bencode"
+	"github.com/lwch/magic/code/data"
+)
+
+// readTestError read error response sent to remote
+func readTestError(t *testing.T, remote *net.UDPConn) data.ErrorResponse {
+	var rep data.ErrorResponse
+	buf := readTestPacket(t, remote, time.Second)
+	err := bencode.Decode(buf, &rep)
+	if err != nil || rep.Type != "e" {
+		t.Fatalf("unexpected response: %q", buf)
+	}
+	return rep
+}
+
+func TestSendError(t *testing.T) {
+	dht, remote := newTestDHT(t)
+	defer closeTestDHT(dht, remote)
+	addr := remote.LocalAddr().(*net.UDPAddr)
+	var id hashType
+	id[0] = 1
+	req := "d1:ad2:id20:" + string(id[:]) + "e1:q7:unknown1:t2:aa1:y1:qe"
+	dht.handleData(addr, []byte(req))
+	rep := readTestError(t, remote)
+	if rep.Transaction != "aa" || rep.Code() != data.ErrMethodUnknown {
+		t.Fatalf("unexpected error: %d %s", rep.Code(), rep.Message())
+	}
+	// request without id from unknown node
+	dht.handleData(&net.UDPAddr{IP: addr.IP, Port: addr.Port}, []byte("d1:ad2:id20:"+
+		string(emptyHash[:])+"e1:q4:ping1:t2:bb1:y1:qe"))
+	rep = readTestError(t, remote)
+	if rep.Transaction != "bb" || rep.Code() != data.ErrProtocol {
+		t.Fatalf("unexpected error: %d %s", rep.Code(), rep.Message())
+	}
+}
+
+func TestRecvError(t *testing.T) {
+	dht, remote := newTestDHT(t)
+	defer closeTestDHT(dht, remote)
+	n := newTestNode(dht, remote)
+	dht.tb.add(n)
+	lk, err := dht.newLookup(data.TypeFindNode, data.RandID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lk.next()
+	tx := readTestRequest(t, remote, data.TypeFindNode)
+	buf, err := data.ErrorRep(tx, data.ErrServer, "server error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dht.handleData(&n.addr, buf)
+	resp := <-lk.chResp
+	if !resp.failed || n.failed != 1 {
+		t.Fatal("error response is not handled")
+	}
+	lk.handle(resp)
+	if lk.next() {
+		t.Fatal("failed node is queried again")
+	}
+}
@@ -1,8 +1,8 @@
 package dht
 
 import (
-	"bytes"
 	"encoding/binary"
+	"net"
 
 	"github.com/lwch/bencode"
 	"github.com/lwch/magic/code/data"
@@ -16,31 +16,74 @@ func (n *node) onPing(buf []byte) {
 		logging.Error("decode ping request failed" + n.errInfo(err))
 		return
 	}
-	data, err := data.PingRep(req.Transaction, n.dht.local)
+	data, err := data.PingRep(req.Transaction, n.dht.localID())
 	if err != nil {
 		logging.Error("build ping response packet failed" + n.errInfo(err))
 		return
 	}
-	_, err = n.dht.listen.WriteTo(data, &n.addr)
+	err = n.dht.send(data, &n.addr)
 	if err != nil {
 		logging.Error("send ping response packet failed" + n.errInfo(err))
 		return
 	}
 }
 
-func compactNodes(nodes []*node) []byte {
-	ret := make([]byte, len(nodes)*26)
-	for i := 0; i < len(nodes); i++ {
-		node := nodes[i]
-		copy(ret[i*26:], node.id[:])
-		var ipPort bytes.Buffer
-		binary.Write(&ipPort, binary.BigEndian, node.addr.IP)
-		binary.Write(&ipPort, binary.BigEndian, uint16(node.addr.Port))
-		copy(ret[i*26+20:], ipPort.Bytes())
+// compactNodes encode nodes in 26 bytes(ipv4) or 38 bytes(ipv6) each,
+// nodes in other address family are skipped
+func compactNodes(nodes []*node, ipLen int) []byte {
+	ret := make([]byte, 0, len(nodes)*(20+ipLen+2))
+	for _, node := range nodes {
+		ip := compactIP(node.addr.IP, ipLen)
+		if ip == nil {
+			continue
+		}
+		var port [2]byte
+		binary.BigEndian.PutUint16(port[:], uint16(node.addr.Port))
+		ret = append(ret, node.id[:]...)
+		ret = append(ret, ip...)
+		ret = append(ret, port[:]...)
 	}
 	return ret
 }
 
+func compactIP(ip net.IP, ipLen int) net.IP {
+	if ipLen == net.IPv4len {
+		return ip.To4()
+	}
+	if ip.To4() != nil {
+		return nil
+	}
+	return ip.To16()
+}
+
+// http://www.bittorrent.org/beps/bep_0032.html
+func (n *node) wantNodes(want []string, id hashType) (string, string) {
+	var want4, want6 bool
+	for _, w := range want {
+		switch w {
+		case data.WantNodes4:
+			want4 = true
+		case data.WantNodes6:
+			want6 = true
+		}
+	}
+	if !want4 && !want6 {
+		if n.addr.IP.To4() != nil {
+			want4 = true
+		} else {
+			want6 = true
+		}
+	}
+	var nodes, nodes6 string
+	if want4 {
+		nodes = string(compactNodes(n.dht.tb.neighbor(id), net.IPv4len))
+	}
+	if want6 && n.dht.tb6 != nil {
+		nodes6 = string(compactNodes(n.dht.tb6.neighbor(id), net.IPv6len))
+	}
+	return nodes, nodes6
+}
+
 func (n *node) onFindNode(buf []byte) {
 	var req data.FindRequest
 	err := bencode.Decode(buf, &req)
@@ -48,13 +91,13 @@ func (n *node) onFindNode(buf []byte) {
 		logging.Error("decode find_node request failed" + n.errInfo(err))
 		return
 	}
-	nodes := n.dht.tb.neighbor(req.Data.Target)
-	data, err := data.FindRep(req.Transaction, n.dht.local, string(compactNodes(nodes)))
+	nodes, nodes6 := n.wantNodes(req.Data.Want, req.Data.Target)
+	data, err := data.FindRep(req.Transaction, n.dht.localID(), nodes, nodes6)
 	if err != nil {
 		logging.Error("build find_node response packet faield" + n.errInfo(err))
 		return
 	}
-	_, err = n.dht.listen.WriteTo(data, &n.addr)
+	err = n.dht.send(data, &n.addr)
 	if err != nil {
 		logging.Error("send find_node response packet failed" + n.errInfo(err))
 		return
@@ -69,19 +112,34 @@ func (n *node) onGetPeers(buf []byte) {
 		return
 	}
 	// logging.Info("get_peers: %x", req.Data.Hash)
-	nodes := n.dht.tb.neighbor(req.Data.Hash)
-	data, err := data.GetPeersNotFound(req.Transaction, n.dht.local, data.Rand(16), string(compactNodes(nodes)))
-	if err != nil {
-		logging.Error("build get_peers not found response packet faield" + n.errInfo(err))
-		return
-	}
-	_, err = n.dht.listen.WriteTo(data, &n.addr)
-	if err != nil {
-		logging.Error("send get_peers not found response packet failed" + n.errInfo(err))
-		return
+	token := n.dht.token.gen(n.addr.IP)
+	if values := n.dht.peers.get(req.Data.Hash, n.addr.IP, maxPeerValues); len(values) > 0 {
+		data, err := data.GetPeersFound(req.Transaction, n.dht.localID(), token, values)
+		if err != nil {
+			logging.Error("build get_peers response packet failed" + n.errInfo(err))
+			return
+		}
+		err = n.dht.send(data, &n.addr)
+		if err != nil {
+			logging.Error("send get_peers response packet failed" + n.errInfo(err))
+			return
+		}
+	} else {
+		nodes, nodes6 := n.wantNodes(req.Data.Want, req.Data.Hash)
+		data, err := data.GetPeersNotFound(req.Transaction, n.dht.localID(), token, nodes, nodes6)
+		if err != nil {
+			logging.Error("build get_peers not found response packet faield" + n.errInfo(err))
+			return
+		}
+		err = n.dht.send(data, &n.addr)
+		if err != nil {
+			logging.Error("send get_peers not found response packet failed" + n.errInfo(err))
+			return
+		}
 	}
+	n.dht.res.demand(req.Data.Hash)
 	if n.dht.even%2 == 1 {
-		for _, node := range nodes {
+		for _, node := range n.dht.tableFor(n.addr.IP).neighbor(req.Data.Hash) {
 			node.sendGet(req.Data.Hash)
 		}
 	}
@@ -95,23 +153,122 @@ func (n *node) onAnnouncePeer(buf []byte) {
 		logging.Error("decode announce_peer request failed" + n.errInfo(err))
 		return
 	}
+	if !n.dht.token.verify(n.addr.IP, req.Data.Token) {
+		n.sendError(req.Transaction, data.ErrProtocol, "bad token")
+		return
+	}
 	port := req.Data.Port
 	if req.Data.Implied != 0 {
 		port = uint16(n.addr.Port)
 	}
-	data, err := data.AnnouncePeer(req.Transaction, n.dht.local)
+	data, err := data.AnnouncePeer(req.Transaction, n.dht.localID())
 	if err != nil {
 		logging.Error("build announce_peer response packet failed" + n.errInfo(err))
 		return
 	}
-	_, err = n.dht.listen.WriteTo(data, &n.addr)
+	err = n.dht.send(data, &n.addr)
 	if err != nil {
 		logging.Error("send announce_peer packet failed" + n.errInfo(err))
 		return
 	}
+	n.dht.peers.add(req.Data.Hash, n.addr.IP, port)
 	n.dht.res.push(resReq{
 		id:   req.Data.Hash,
 		ip:   n.addr.IP,
 		port: port,
 	})
 }
+
+// http://www.bittorrent.org/beps/bep_0051.html
+func (n *node) onSampleInfohashes(buf []byte) {
+	var req data.SampleInfohashesRequest
+	err := bencode.Decode(buf, &req)
+	if err != nil {
+		logging.Error("decode sample_infohashes request failed" + n.errInfo(err))
+		return
+	}
+	hashes, num := n.dht.peers.sample(maxSamples)
+	samples := make([]byte, 0, len(hashes)*20)
+	for _, hash := range hashes {
+		samples = append(samples, hash[:]...)
+	}
+	nodes, nodes6 := n.wantNodes(req.Data.Want, req.Data.Target)
+	data, err := data.SampleInfohashesRep(req.Transaction, n.dht.localID(),
+		sampleRepInterval, num, string(samples), nodes, nodes6)
+	if err != nil {
+		logging.Error("build sample_infohashes response packet failed" + n.errInfo(err))
+		return
+	}
+	err = n.dht.send(data, &n.addr)
+	if err != nil {
+		logging.Error("send sample_infohashes response packet failed" + n.errInfo(err))
+		return
+	}
+}
+
+// http://www.bittorrent.org/beps/bep_0044.html
+func (n *node) onGet(buf []byte) {
+	req, err := data.ParseGetReq(buf)
+	if err != nil {
+		logging.Error("decode get request failed" + n.errInfo(err))
+		n.sendError(req.Transaction, data.ErrProtocol, "invalid arguments")
+		return
+	}
+	token := n.dht.token.gen(n.addr.IP)
+	nodes, nodes6 := n.wantNodes(req.Want, req.Target)
+	item := n.dht.items.get(req.Target)
+	data, err := data.GetRep(req.Transaction, n.dht.localID(), token, nodes, nodes6, item, req.Seq)
+	if err != nil {
+		logging.Error("build get response packet failed" + n.errInfo(err))
+		return
+	}
+	err = n.dht.send(data, &n.addr)
+	if err != nil {
+		logging.Error("send get response packet failed" + n.errInfo(err))
+		return
+	}
+}
+
+// http://www.bittorrent.org/beps/bep_0044.html
+func (n *node) onPut(buf []byte) {
+	req, err := data.ParsePutReq(buf)
+	if err != nil {
+		logging.Error("decode put request failed" + n.errInfo(err))
+		n.sendError(req.Transaction, data.ErrProtocol, "invalid arguments")
+		return
+	}
+	if !n.dht.token.verify(n.addr.IP, req.Token) {
+		n.sendError(req.Transaction, data.ErrProtocol, "bad token")
+		return
+	}
+	if len(req.Item.V) > data.MaxItemSize {
+		n.sendError(req.Transaction, data.ErrMessageTooBig, "message (v field) too big")
+		return
+	}
+	if len(req.Item.Salt) > data.MaxSaltSize {
+		n.sendError(req.Transaction, data.ErrSaltTooBig, "salt (salt field) too big")
+		return
+	}
+	if !req.Item.Verify() {
+		n.sendError(req.Transaction, data.ErrInvalidSignature, "invalid signature")
+		return
+	}
+	if code, msg := n.dht.items.put(req.Item, req.Cas); code != 0 {
+		n.sendError(req.Transaction, code, msg)
+		return
+	}
+	data, err := data.PutRep(req.Transaction, n.dht.localID())
+	if err != nil {
+		logging.Error("build put response packet failed" + n.errInfo(err))
+		return
+	}
+	err = n.dht.send(data, &n.addr)
+	if err != nil {
+		logging.Error("send put response packet failed" + n.errInfo(err))
+		return
+	}
+}
+
+func (n *node) sendError(tx string, code int, msg string) {
+	n.dht.sendError(&n.addr, tx, code, msg)
+}
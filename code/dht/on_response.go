@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"net"
-	"strings"
 	"time"
 
 	"github.com/lwch/bencode"
@@ -20,52 +19,95 @@ func (n *node) onFindNodeResp(buf []byte) {
 			n.id.String(), n.addr.String(), err)
 		return
 	}
-	if len(resp.Response.Nodes)%26 > 0 {
+	if len(resp.Response.Nodes)%26 > 0 ||
+		len(resp.Response.Nodes6)%38 > 0 {
 		logging.Error("invalid find_node response node data length, id=%s, addr=%s",
 			n.id.String(), n.addr.String())
 		return
 	}
 	var nodes []*node
 	var txs []string
-	for i := 0; i < len(resp.Response.Nodes); i += 26 {
+	nodes, txs = n.pingNodes(resp.Response.Nodes, net.IPv4len, nodes, txs)
+	if n.dht.listen6 != nil {
+		// http://www.bittorrent.org/beps/bep_0032.html
+		nodes, txs = n.pingNodes(resp.Response.Nodes6, net.IPv6len, nodes, txs)
+	}
+	if len(nodes) > 0 {
+		go waitPing(n.dht, nodes, txs)
+	}
+}
+
+// waitPing add nodes to table when pong received
+func waitPing(dht *DHT, nodes []*node, txs []string) {
+	defer func() {
+		for _, tx := range txs {
+			dht.init.unset(tx)
+		}
+	}()
+	waitNodes(nodes)
+}
+
+type compactNode struct {
+	id   hashType
+	addr net.UDPAddr
+}
+
+// decodeNodes decode compact node info, ipLen is 4 for nodes or 16 for nodes6
+func decodeNodes(compact string, ipLen int) []compactNode {
+	size := 20 + ipLen + 2
+	ret := make([]compactNode, 0, len(compact)/size)
+	for i := 0; i+size <= len(compact); i += size {
 		var id hashType
-		copy(id[:], resp.Response.Nodes[i:i+20])
-		if n.dht.tb.findID(id) != nil {
+		copy(id[:], compact[i:i+20])
+		ip, port := parseCompactAddr(compact[i+20 : i+size])
+		if ip == nil || port == 0 {
 			continue
 		}
-		var ip [4]byte
-		err = binary.Read(strings.NewReader(resp.Response.Nodes[i+20:]), binary.BigEndian, &ip)
-		if err != nil {
-			logging.Error("read ip failed, id=%s, addr=%s, err=%v",
-				n.id.String(), n.addr.String(), err)
+		ret = append(ret, compactNode{
+			id: id,
+			addr: net.UDPAddr{
+				IP:   ip,
+				Port: int(port),
+			},
+		})
+	}
+	return ret
+}
+
+// pingNodes ping nodes in compact node info, ipLen is 4 for nodes or 16 for nodes6
+func (n *node) pingNodes(compact string, ipLen int, nodes []*node, txs []string) ([]*node, []string) {
+	for _, cn := range decodeNodes(compact, ipLen) {
+		if cn.id.equal(n.dht.localID()) {
 			continue
 		}
-		port := binary.BigEndian.Uint16([]byte(resp.Response.Nodes[i+24:]))
-		if port == 0 {
+		if n.dht.tableFor(cn.addr.IP).findID(cn.id) != nil {
 			continue
 		}
-		addr := net.UDPAddr{
-			IP:   net.IP(ip[:]),
-			Port: int(port),
-		}
-		node := newNode(n.dht, id, addr)
+		node := newNode(n.dht, cn.id, cn.addr)
 		tx := node.sendPing(n.dht.init)
 		nodes = append(nodes, node)
 		txs = append(txs, tx)
 	}
-	if len(nodes) > 0 {
-		go func(nodes []*node, txs []string) {
-			defer func() {
-				for _, tx := range txs {
-					n.dht.init.unset(tx)
-				}
-			}()
-			waitNodes(nodes, n.dht.tb)
-		}(nodes, txs)
+	return nodes, txs
+}
+
+// parseCompactAddr parse 6 bytes(ipv4) or 18 bytes(ipv6) compact address
+func parseCompactAddr(compact string) (net.IP, uint16) {
+	var ipLen int
+	switch len(compact) {
+	case net.IPv4len + 2:
+		ipLen = net.IPv4len
+	case net.IPv6len + 2:
+		ipLen = net.IPv6len
+	default:
+		return nil, 0
 	}
+	ip := make(net.IP, ipLen)
+	copy(ip, compact[:ipLen])
+	return ip, binary.BigEndian.Uint16([]byte(compact[ipLen:]))
 }
 
-func waitNodes(nodes []*node, tb *table) {
+func waitNodes(nodes []*node) {
 	timeout := time.After(10 * time.Second)
 	done := make([]bool, len(nodes))
 loop:
@@ -76,7 +118,7 @@ loop:
 			}
 			select {
 			case <-node.chPong:
-				tb.add(node)
+				node.dht.tableFor(node.addr.IP).add(node)
 				done[i] = true
 			case <-timeout:
 				return
@@ -103,9 +145,10 @@ func (n *node) onGetPeersResp(buf []byte, hash hashType) {
 		logging.Error("decode get_peers response(notfound) failed" + n.errInfo(err))
 		return
 	}
-	if len(notfound.Response.Nodes) > 0 {
+	// the response may contains both nodes and values
+	if len(notfound.Response.Nodes) > 0 ||
+		len(notfound.Response.Nodes6) > 0 {
 		n.onFindNodeResp(buf)
-		return
 	}
 	var found data.GetPeersResponse
 	err = bencode.Decode(buf, &found)
@@ -113,22 +156,38 @@ func (n *node) onGetPeersResp(buf []byte, hash hashType) {
 		// logging.Error("decode get_peers response(found) failed" + n.errInfo(err))
 		return
 	}
-	// n.dht.tk.add(found.Response.Token, hash, n.id)
 	for _, peer := range found.Response.Values {
-		if len(peer) != 6 {
-			continue
-		}
-		var ip [4]byte
-		err = binary.Read(strings.NewReader(peer), binary.BigEndian, &ip)
-		if err != nil {
-			logging.Error("read ip failed" + n.errInfo(err))
+		ip, port := parseCompactAddr(peer)
+		if ip == nil || port == 0 {
 			continue
 		}
-		port := binary.BigEndian.Uint16([]byte(peer[4:]))
 		n.dht.res.push(resReq{
 			id:   hash,
-			ip:   net.IP(ip[:]),
+			ip:   ip,
 			port: port,
 		})
 	}
 }
+
+// http://www.bittorrent.org/beps/bep_0051.html
+func (n *node) onSampleInfohashesResp(buf []byte) {
+	var resp data.SampleInfohashesResponse
+	err := bencode.Decode(buf, &resp)
+	if err != nil {
+		logging.Error("decode sample_infohashes response failed" + n.errInfo(err))
+		return
+	}
+	if n.dht.sample != nil {
+		n.dht.sample.setInterval(n.addr.String(), resp.Response.Interval)
+	}
+	samples := resp.Response.Samples
+	for i := 0; i+20 <= len(samples); i += 20 {
+		var hash hashType
+		copy(hash[:], samples[i:i+20])
+		// the peers are pushed to resMgr in onGetPeersResp
+		n.sendGet(hash)
+	}
+	if len(resp.Response.Nodes) > 0 || len(resp.Response.Nodes6) > 0 {
+		n.onFindNodeResp(buf)
+	}
+}
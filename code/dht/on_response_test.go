@@ -0,0 +1,36 @@
+package dht
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGetPeersRespValues(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Listen = 16884
+	cfg.DisableIPv6 = true
+	dht, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dht.Close()
+	var id, hash hashType
+	id[0], hash[0] = 1, 2
+	n := newNode(dht, id, net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	// both nodes6 and values in response
+	buf := []byte("d1:rd2:id20:" + string(id[:]) + "6:nodes638:" + string(make([]byte, 38)) +
+		"5:token1:x6:valuesl6:\x01\x02\x03\x04\x00\x05ee1:t2:aa1:y1:re")
+	n.onGetPeersResp(buf, hash)
+	dht.res.jobLock.Lock()
+	job := dht.res.jobs[hash]
+	dht.res.jobLock.Unlock()
+	if job == nil {
+		t.Fatal("values are ignored")
+	}
+	job.Lock()
+	defer job.Unlock()
+	// the peer may be taken by fetch worker
+	if len(job.peers)+len(job.tried) != 1 {
+		t.Fatalf("unexpected peers: %v", job.peers)
+	}
+}
@@ -0,0 +1,129 @@
+package dht
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+type peerInfo struct {
+	ip       net.IP
+	port     uint16
+	deadline time.Time
+}
+
+// compact encode peer in 6 bytes(ipv4) or 18 bytes(ipv6)
+func (p peerInfo) compact() string {
+	ip := p.ip
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	ret := make([]byte, len(ip)+2)
+	copy(ret, ip)
+	binary.BigEndian.PutUint16(ret[len(ip):], p.port)
+	return string(ret)
+}
+
+// peerStore announced peers by info_hash
+type peerStore struct {
+	sync.Mutex
+	data      map[hashType][]peerInfo
+	maxHashes int
+	maxPeers  int
+	timeout   time.Duration
+}
+
+func newPeerStore(maxHashes, maxPeers int, timeout time.Duration) *peerStore {
+	return &peerStore{
+		data:      make(map[hashType][]peerInfo),
+		maxHashes: maxHashes,
+		maxPeers:  maxPeers,
+		timeout:   timeout,
+	}
+}
+
+func (s *peerStore) add(hash hashType, ip net.IP, port uint16) {
+	s.Lock()
+	defer s.Unlock()
+	deadline := time.Now().Add(s.timeout)
+	peers, ok := s.data[hash]
+	if !ok && len(s.data) >= s.maxHashes {
+		return
+	}
+	oldest := -1
+	for i, peer := range peers {
+		if peer.ip.Equal(ip) && peer.port == port {
+			peers[i].deadline = deadline
+			return
+		}
+		if oldest < 0 || peer.deadline.Before(peers[oldest].deadline) {
+			oldest = i
+		}
+	}
+	peer := peerInfo{
+		ip:       ip,
+		port:     port,
+		deadline: deadline,
+	}
+	if len(peers) >= s.maxPeers {
+		peers[oldest] = peer
+		return
+	}
+	s.data[hash] = append(peers, peer)
+}
+
+// get get compact peers in the same address family as ip, limit by n
+func (s *peerStore) get(hash hashType, ip net.IP, n int) []string {
+	s.Lock()
+	defer s.Unlock()
+	isIPv4 := ip.To4() != nil
+	var ret []string
+	now := time.Now()
+	for _, peer := range s.data[hash] {
+		if len(ret) >= n {
+			break
+		}
+		if now.After(peer.deadline) {
+			continue
+		}
+		if (peer.ip.To4() != nil) != isIPv4 {
+			continue
+		}
+		ret = append(ret, peer.compact())
+	}
+	return ret
+}
+
+func (s *peerStore) clearTimeout() {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for hash, peers := range s.data {
+		left := peers[:0]
+		for _, peer := range peers {
+			if now.Before(peer.deadline) {
+				left = append(left, peer)
+			}
+		}
+		if len(left) == 0 {
+			delete(s.data, hash)
+			continue
+		}
+		s.data[hash] = left
+	}
+}
+
+// sample get at most n info_hash and the count of all info_hash
+func (s *peerStore) sample(n int) ([]hashType, int) {
+	s.Lock()
+	defer s.Unlock()
+	ret := make([]hashType, 0, n)
+	for hash := range s.data {
+		if len(ret) >= n {
+			break
+		}
+		ret = append(ret, hash)
+	}
+	return ret, len(s.data)
+}
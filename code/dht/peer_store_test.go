@@ -0,0 +1,32 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerStore(t *testing.T) {
+	s := newPeerStore(1, 2, time.Minute)
+	var hash, other hashType
+	other[0] = 1
+	s.add(hash, net.ParseIP("1.1.1.1"), 1)
+	s.add(hash, net.ParseIP("1.1.1.1"), 1)
+	s.add(hash, net.ParseIP("2001:db8::1"), 2)
+	s.add(other, net.ParseIP("1.1.1.1"), 1)
+	if len(s.data) != 1 {
+		t.Fatalf("unexpected hash count: %d", len(s.data))
+	}
+	values := s.get(hash, net.ParseIP("8.8.8.8"), maxPeerValues)
+	if len(values) != 1 || len(values[0]) != 6 {
+		t.Fatalf("unexpected ipv4 values: %q", values)
+	}
+	values = s.get(hash, net.ParseIP("2001:db8::2"), maxPeerValues)
+	if len(values) != 1 || len(values[0]) != 18 {
+		t.Fatalf("unexpected ipv6 values: %q", values)
+	}
+	s.add(hash, net.ParseIP("3.3.3.3"), 3)
+	if len(s.data[hash]) != 2 {
+		t.Fatalf("unexpected peer count: %d", len(s.data[hash]))
+	}
+}
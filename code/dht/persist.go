@@ -0,0 +1,174 @@
+package dht
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lwch/magic/code/data"
+	"github.com/lwch/magic/code/logging"
+)
+
+const restoreBatch = 200 // saved nodes pinged each second
+
+type savedNode struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+	Seen int64  `json:"seen"`
+}
+
+// saveNodes save the most recently seen nodes to file
+func (dht *DHT) saveNodes() error {
+	if len(dht.nodesFile) == 0 || dht.readOnly {
+		return nil
+	}
+	nodes := dht.tb.allNodes()
+	if dht.tb6 != nil {
+		nodes = append(nodes, dht.tb6.allNodes()...)
+	}
+	list := make([]savedNode, 0, len(nodes))
+	for _, n := range nodes {
+		if n.isBootstrap {
+			continue
+		}
+		list = append(list, savedNode{
+			ID:   n.id.String(),
+			Addr: n.addr.String(),
+			Seen: n.updated.Unix(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Seen > list[j].Seen
+	})
+	if len(list) > dht.maxSaveNodes {
+		list = list[:dht.maxSaveNodes]
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	tmp := dht.nodesFile + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, dht.nodesFile)
+}
+
+func loadNodes(file string) ([]savedNode, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var list []savedNode
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// restore ping nodes saved in last run, the most recently seen nodes are pinged
+// first and the others are pinged batch by batch, returns count of nodes to ping
+func (dht *DHT) restore() int {
+	if len(dht.nodesFile) == 0 {
+		return 0
+	}
+	list, err := loadNodes(dht.nodesFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Error("load nodes from %s failed: %v", dht.nodesFile, err)
+		}
+		return 0
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Seen > list[j].Seen
+	})
+	var nodes []*node
+	for _, saved := range list {
+		var id hashType
+		raw, err := hex.DecodeString(saved.ID)
+		if err != nil || len(raw) != len(id) {
+			continue
+		}
+		copy(id[:], raw)
+		addr, err := net.ResolveUDPAddr("udp", saved.Addr)
+		if err != nil {
+			continue
+		}
+		if addr.IP.To4() == nil && dht.listen6 == nil {
+			continue
+		}
+		n := newNode(dht, id, *addr)
+		n.updated = time.Unix(saved.Seen, 0)
+		nodes = append(nodes, n)
+	}
+	logging.Info("restore %d nodes from %s", len(nodes), dht.nodesFile)
+	if len(nodes) <= restoreBatch {
+		dht.pingSaved(nodes)
+		return len(nodes)
+	}
+	dht.pingSaved(nodes[:restoreBatch])
+	go func(nodes []*node) {
+		tk := time.NewTicker(time.Second)
+		defer tk.Stop()
+		for len(nodes) > 0 {
+			select {
+			case <-tk.C:
+			case <-dht.ctx.Done():
+				return
+			}
+			size := restoreBatch
+			if size > len(nodes) {
+				size = len(nodes)
+			}
+			dht.pingSaved(nodes[:size])
+			nodes = nodes[size:]
+		}
+	}(nodes[restoreBatch:])
+	return len(nodes)
+}
+
+func (dht *DHT) pingSaved(nodes []*node) {
+	if len(nodes) == 0 {
+		return
+	}
+	txs := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		txs = append(txs, n.sendPing(dht.init))
+		n.sendDiscovery(dht.gen)
+	}
+	go waitPing(dht, nodes, txs)
+}
+
+// loadID load local node id from file, generate and save it when not exists
+func loadID(file string) (hashType, error) {
+	var id hashType
+	content, err := ioutil.ReadFile(file)
+	if err == nil {
+		raw, err := hex.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil {
+			return id, err
+		}
+		if len(raw) != len(id) {
+			return id, fmt.Errorf("invalid node id length: %d", len(raw))
+		}
+		copy(id[:], raw)
+		return id, nil
+	}
+	if !os.IsNotExist(err) {
+		return id, err
+	}
+	id = data.RandID()
+	return id, saveID(file, id)
+}
+
+func saveID(file string, id hashType) error {
+	return ioutil.WriteFile(file, []byte(id.String()), 0644)
+}
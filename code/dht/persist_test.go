@@ -0,0 +1,120 @@
+package dht
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lwch/magic/code/data"
+)
+
+func TestNodesReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "nodes.json")
+	err = ioutil.WriteFile(file, []byte("[]"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := NewConfig()
+	cfg.Listen = 16891
+	cfg.DisableIPv6 = true
+	cfg.NodesFile = file
+	cfg.NodesReadOnly = true
+	dht, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dht.tb.add(newNode(dht, data.RandID(), net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1}))
+	dht.Close()
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != "[]" {
+		t.Fatalf("nodes file is overwritten: %s", raw)
+	}
+}
+
+func TestRestoreBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// ping and find_node of the first batch are sent at once
+	conn.(*net.UDPConn).SetReadBuffer(1 << 20)
+	pinged := make(chan struct{}, 2*restoreBatch)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pkt, err := data.ParsePacket(buf[:n])
+			if err == nil && pkt.Query == data.TypePing {
+				pinged <- struct{}{}
+			}
+		}
+	}()
+	var list []savedNode
+	for i := 0; i < restoreBatch+10; i++ {
+		id := data.RandID()
+		list = append(list, savedNode{
+			ID:   hex.EncodeToString(id[:]),
+			Addr: conn.LocalAddr().String(),
+			Seen: int64(i),
+		})
+	}
+	raw, _ := json.Marshal(list)
+	file := filepath.Join(dir, "nodes.json")
+	err = ioutil.WriteFile(file, raw, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := NewConfig()
+	cfg.Listen = 16899
+	cfg.DisableIPv6 = true
+	cfg.NodesFile = file
+	cfg.NodesReadOnly = true
+	dht, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dht.Close()
+	if cnt := dht.restore(); cnt != len(list) {
+		t.Fatalf("unexpected restored: %d", cnt)
+	}
+	count := func(wait time.Duration) int {
+		timeout := time.After(wait)
+		cnt := 0
+		for {
+			select {
+			case <-pinged:
+				cnt++
+			case <-timeout:
+				return cnt
+			}
+		}
+	}
+	if cnt := count(500 * time.Millisecond); cnt != restoreBatch {
+		t.Fatalf("unexpected pinged in first batch: %d", cnt)
+	}
+	if cnt := count(time.Second); cnt != 10 {
+		t.Fatalf("unexpected pinged in second batch: %d", cnt)
+	}
+}
@@ -8,15 +8,28 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lwch/bencode"
 	"github.com/lwch/magic/code/data"
 	"github.com/lwch/magic/code/logging"
+	"github.com/lwch/magic/code/mse"
 )
 
 const protocol = "BitTorrent protocol"
 const resTimeout = 10 * time.Second
+const maxMetaSize = 16 * 1024 * 1024
+const maxFetchPeers = 20 // max peers to try of each info_hash
+const badPeerTimeout = time.Hour
+const dialTimeout = 5 * time.Second
+
+var errRejected = errors.New("request rejected")
+var errHashMismatch = errors.New("hash mismatch")
+var errSizeMismatch = errors.New("metadata size mismatch")
+var errPieceSize = errors.New("invalid piece size")
 
 // http://www.bittorrent.org/beps/bep_0010.html
 const extMsgID = byte(20)
@@ -34,7 +47,7 @@ type resReq struct {
 }
 
 func (r resReq) addr() string {
-	return fmt.Sprintf("%s:%d", r.ip.String(), r.port)
+	return net.JoinHostPort(r.ip.String(), strconv.Itoa(int(r.port)))
 }
 
 func (r resReq) errInfo(err error) string {
@@ -47,54 +60,154 @@ func (r resReq) logInfo() string {
 		r.id.String(), r.addr())
 }
 
-// MetaFile file info
-type MetaFile struct {
-	Path   []string `json:"path"`
-	Length int      `json:"length"`
-}
-
-// MetaInfo meta info
-type MetaInfo struct {
-	Hash       string     `json:"hash"`
-	Peer       string     `json:"peer"`
-	Name       string     `json:"name"`
-	Length     int        `json:"length"`
-	MetaLength int        `json:"meta_length"`
-	Files      []MetaFile `json:"files,omitempty"`
+// FetchStats counters of metadata fetch
+type FetchStats struct {
+	Queued    int64 `json:"queued"`
+	InFlight  int64 `json:"in_flight"`
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+	Dropped   int64 `json:"dropped"`   // dropped when queue is full or output is blocked
+	Skipped   int64 `json:"skipped"`   // skipped by seen set, backoff or Config.ShouldFetch
+	TCP       int64 `json:"tcp"`       // peers handshaked by tcp
+	UTP       int64 `json:"utp"`       // peers handshaked by utp, bep_0029
+	Encrypted int64 `json:"encrypted"` // peers handshaked by rc4 encryption
 }
 
 type resMgr struct {
-	dht   *DHT
-	chReq chan resReq
+	dht         *DHT
+	queue       *fetchQueue
+	timeout     time.Duration
+	concurrency int
+	dropPad     bool
+	seen        *seenSet
+	neg         *negCache
+	shouldFetch func([20]byte) bool
+	transport   Transport
+	encryption  mse.Policy
+
+	inflight  int64
+	succeeded int64
+	failed    int64
+	dropped   int64
+	skipped   int64
+	tcp       int64
+	utp       int64
+	encrypted int64
+
+	jobLock sync.Mutex
+	jobs    map[hashType]*fetchJob // queued and running jobs
+
+	badLock sync.Mutex
+	bad     map[string]time.Time // bad peer address => expire time
 
 	// runtime
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
-func newResMgr(dht *DHT) *resMgr {
+func newResMgr(dht *DHT, cfg *Config) *resMgr {
 	mgr := &resMgr{
-		dht:   dht,
-		chReq: make(chan resReq, 100),
+		dht:         dht,
+		queue:       newFetchQueue(cfg.FetchQueue, cfg.FetchDrop, cfg.FetchPriority),
+		timeout:     cfg.FetchTimeout,
+		concurrency: cfg.FetchConcurrency,
+		dropPad:     cfg.DropPadFiles,
+		seen:        newSeenSet(cfg.MaxSeen, cfg.SeenWindow),
+		neg:         newNegCache(cfg.MaxFailed, cfg.FailBackoff, cfg.MaxFailBackoff),
+		shouldFetch: cfg.ShouldFetch,
+		transport:   cfg.FetchTransport,
+		encryption:  cfg.FetchEncryption,
+		jobs:        make(map[hashType]*fetchJob),
+		bad:         make(map[string]time.Time),
 	}
 	mgr.ctx, mgr.cancel = context.WithCancel(context.Background())
-	go mgr.loopGet()
+	for i := 0; i < cfg.FetchWorkers; i++ {
+		go mgr.loopGet()
+	}
 	return mgr
 }
 
+// push add request to queue, it never blocks, the requests of
+// the same info_hash are merged into one fetch job
 func (mgr *resMgr) push(r resReq) {
-	mgr.chReq <- r
+	if mgr.seen.has(r.id) || mgr.neg.blocked(r.id) {
+		atomic.AddInt64(&mgr.skipped, 1)
+		return
+	}
+	mgr.jobLock.Lock()
+	defer mgr.jobLock.Unlock()
+	if job, ok := mgr.jobs[r.id]; ok {
+		job.addPeer(r)
+		mgr.queue.announce(r.id, r.ip)
+		return
+	}
+	job := newFetchJob(mgr, r.id)
+	job.addPeer(r)
+	mgr.jobs[r.id] = job
+	for _, id := range mgr.queue.push(r.id, r.ip) {
+		delete(mgr.jobs, id)
+		atomic.AddInt64(&mgr.dropped, 1)
+	}
+}
+
+// demand add get_peers query of info_hash to its priority
+func (mgr *resMgr) demand(id hashType) {
+	mgr.queue.demand(id)
+}
+
+func (mgr *resMgr) stats() FetchStats {
+	return FetchStats{
+		Queued:    int64(mgr.queue.size()),
+		InFlight:  atomic.LoadInt64(&mgr.inflight),
+		Succeeded: atomic.LoadInt64(&mgr.succeeded),
+		Failed:    atomic.LoadInt64(&mgr.failed),
+		Dropped:   atomic.LoadInt64(&mgr.dropped),
+		Skipped:   atomic.LoadInt64(&mgr.skipped),
+		TCP:       atomic.LoadInt64(&mgr.tcp),
+		UTP:       atomic.LoadInt64(&mgr.utp),
+		Encrypted: atomic.LoadInt64(&mgr.encrypted),
+	}
 }
 
 func (mgr *resMgr) close() {
 	mgr.cancel()
 }
 
+func (mgr *resMgr) setBad(addr string) {
+	mgr.badLock.Lock()
+	mgr.bad[addr] = time.Now().Add(badPeerTimeout)
+	mgr.badLock.Unlock()
+}
+
+func (mgr *resMgr) isBad(addr string) bool {
+	mgr.badLock.Lock()
+	defer mgr.badLock.Unlock()
+	deadline, ok := mgr.bad[addr]
+	return ok && time.Now().Before(deadline)
+}
+
+func (mgr *resMgr) clearTimeout() {
+	mgr.seen.clearTimeout()
+	mgr.neg.clearTimeout()
+	mgr.badLock.Lock()
+	defer mgr.badLock.Unlock()
+	now := time.Now()
+	for addr, deadline := range mgr.bad {
+		if now.After(deadline) {
+			delete(mgr.bad, addr)
+		}
+	}
+}
+
 func (mgr *resMgr) loopGet() {
 	for {
+		id, ok := mgr.queue.pop()
+		if ok {
+			mgr.get(id, mgr.dht.Out)
+			continue
+		}
 		select {
-		case req := <-mgr.chReq:
-			go mgr.get(req, mgr.dht.Out)
+		case <-mgr.queue.chNotify:
 		case <-mgr.ctx.Done():
 			return
 		}
@@ -188,10 +301,10 @@ func sendExtHeader(c net.Conn) error {
 	return sendMessage(c, extMsgID, 0, raw)
 }
 
-func readExtHeader(c net.Conn) (byte, int, int, error) {
+func readExtHeader(c net.Conn) (byte, int, int, string, error) {
 	_, _, data, err := readMessage(c)
 	if err != nil {
-		return 0, 0, 0, err
+		return 0, 0, 0, "", err
 	}
 	// http://www.bittorrent.org/beps/bep_0010.html
 	var hdr struct {
@@ -205,16 +318,16 @@ func readExtHeader(c net.Conn) (byte, int, int, error) {
 	}
 	err = bencode.Decode(data, &hdr)
 	if err != nil {
-		return 0, 0, 0, err
+		return 0, 0, 0, "", err
 	}
-	if hdr.Size == 0 {
-		return byte(hdr.Data.Type), 0, 0, nil
+	if hdr.Size <= 0 {
+		return byte(hdr.Data.Type), 0, 0, hdr.IP, nil
 	}
-	pieces := float64(hdr.Size)/float64(blockSize) + .5
-	if pieces < 1 {
-		pieces = 1
+	if hdr.Size > maxMetaSize {
+		return 0, 0, 0, "", fmt.Errorf("metadata too large: %d", hdr.Size)
 	}
-	return byte(hdr.Data.Type), hdr.Size, int(pieces), nil
+	pieces := (hdr.Size + blockSize - 1) / blockSize
+	return byte(hdr.Data.Type), hdr.Size, pieces, hdr.IP, nil
 }
 
 // http://www.bittorrent.org/beps/bep_0009.html#request
@@ -234,62 +347,298 @@ func requestPiece(c net.Conn, metaData byte, n int) error {
 	return sendMessage(c, extMsgID, metaData, data)
 }
 
-func (mgr *resMgr) get(r resReq, out chan MetaInfo) {
-	c, err := net.DialTimeout("tcp", r.addr(), 5*time.Second)
-	if err != nil {
-		// logging.Error("*GET* connect failed" + r.errInfo(err))
+// get run the fetch job of info_hash in worker
+func (mgr *resMgr) get(id hashType, out chan MetaInfo) {
+	mgr.jobLock.Lock()
+	job := mgr.jobs[id]
+	mgr.jobLock.Unlock()
+	if job == nil {
 		return
 	}
-	defer c.Close()
-	_, err = c.Write(makeHandshake(r.id))
-	if err != nil {
-		// logging.Error("*GET* send handshake failed" + r.errInfo(err))
+	if mgr.shouldFetch != nil && !mgr.shouldFetch(id) {
+		mgr.seen.add(id)
+		mgr.jobLock.Lock()
+		delete(mgr.jobs, id)
+		mgr.jobLock.Unlock()
+		atomic.AddInt64(&mgr.skipped, 1)
 		return
 	}
-	err = readHandshake(c)
-	if err != nil {
-		// logging.Error("*GET* read handshake failed" + r.errInfo(err))
+	for _, peer := range mgr.announced(id) {
+		job.addPeer(peer)
+	}
+
+	atomic.AddInt64(&mgr.inflight, 1)
+	ctx, cancel := context.WithTimeout(mgr.ctx, mgr.timeout)
+	defer cancel()
+	info := job.run(ctx)
+	if info != nil {
+		mgr.neg.remove(id)
+	} else if mgr.ctx.Err() == nil {
+		mgr.neg.fail(id, job.reason())
+	}
+	mgr.jobLock.Lock()
+	delete(mgr.jobs, id)
+	mgr.jobLock.Unlock()
+	atomic.AddInt64(&mgr.inflight, -1)
+	if info == nil {
+		atomic.AddInt64(&mgr.failed, 1)
 		return
 	}
-	err = sendExtHeader(c)
+	// the metadata may be fetched near the deadline, so output has its own timeout,
+	// and it is not seen until delivered
+	wait := time.NewTimer(mgr.timeout)
+	defer wait.Stop()
+	select {
+	case out <- *info:
+		mgr.seen.add(id)
+		atomic.AddInt64(&mgr.succeeded, 1)
+	case <-wait.C:
+		logging.Debug("*GET* output of %s is blocked, dropped", id.String())
+		atomic.AddInt64(&mgr.dropped, 1)
+	case <-mgr.ctx.Done():
+	}
+}
+
+// announced the peers announced to us of info_hash
+func (mgr *resMgr) announced(id hashType) []resReq {
+	values := append(mgr.dht.peers.get(id, net.IPv4zero, maxPeerValues),
+		mgr.dht.peers.get(id, net.IPv6zero, maxPeerValues)...)
+	var ret []resReq
+	for _, value := range values {
+		ip, port := parseCompactAddr(value)
+		if ip == nil || port == 0 {
+			continue
+		}
+		ret = append(ret, resReq{id: id, ip: ip, port: port})
+	}
+	return ret
+}
+
+// jobConn connection of fetch job, it is closed when the job is done
+// and the deadline never exceeds the deadline of job
+type jobConn struct {
+	net.Conn
+	deadline time.Time // zero when no deadline
+}
+
+func newJobConn(ctx context.Context, c net.Conn) *jobConn {
+	deadline, _ := ctx.Deadline()
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+	return &jobConn{Conn: c, deadline: deadline}
+}
+
+func (c *jobConn) clamp(t time.Time) time.Time {
+	if c.deadline.IsZero() || (!t.IsZero() && t.Before(c.deadline)) {
+		return t
+	}
+	return c.deadline
+}
+
+// SetDeadline set deadline before the deadline of job
+func (c *jobConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetDeadline(c.clamp(t))
+}
+
+// SetReadDeadline set read deadline before the deadline of job
+func (c *jobConn) SetReadDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(c.clamp(t))
+}
+
+// SetWriteDeadline set write deadline before the deadline of job
+func (c *jobConn) SetWriteDeadline(t time.Time) error {
+	return c.Conn.SetWriteDeadline(c.clamp(t))
+}
+
+// peerConn handshaked connection of peer
+type peerConn struct {
+	net.Conn
+	metaData  byte // ut_metadata id
+	metaSize  int
+	pieces    int
+	network   string // tcp or utp
+	encrypted bool
+}
+
+// connect dial peer by transport policy and handshake,
+// the connection is closed when ctx is done
+func (mgr *resMgr) connect(ctx context.Context, r resReq) (*peerConn, error) {
+	pc, err := mgr.connectPolicy(ctx, r)
 	if err != nil {
-		// logging.Error("*GET* send ext header failed" + r.errInfo(err))
-		return
+		return nil, err
+	}
+	// only the returned connection is counted
+	if pc.network == "utp" {
+		atomic.AddInt64(&mgr.utp, 1)
+	} else {
+		atomic.AddInt64(&mgr.tcp, 1)
+	}
+	if pc.encrypted {
+		atomic.AddInt64(&mgr.encrypted, 1)
+	}
+	return pc, nil
+}
+
+func (mgr *resMgr) connectPolicy(ctx context.Context, r resReq) (*peerConn, error) {
+	switch mgr.transport {
+	case TransportTCP:
+		return mgr.connectBy(ctx, r, "tcp")
+	case TransportUTP:
+		return mgr.connectBy(ctx, r, "utp")
+	case TransportTCPFirst:
+		pc, err := mgr.connectBy(ctx, r, "tcp")
+		if err == nil {
+			return pc, nil
+		}
+		return mgr.connectBy(ctx, r, "utp")
+	case TransportUTPFirst:
+		pc, err := mgr.connectBy(ctx, r, "utp")
+		if err == nil {
+			return pc, nil
+		}
+		return mgr.connectBy(ctx, r, "tcp")
+	}
+	// parallel
+	type result struct {
+		pc  *peerConn
+		err error
 	}
-	metaData, metaSize, pieces, err := readExtHeader(c)
+	ch := make(chan result, 2)
+	for _, network := range []string{"tcp", "utp"} {
+		go func(network string) {
+			pc, err := mgr.connectBy(ctx, r, network)
+			ch <- result{pc: pc, err: err}
+		}(network)
+	}
+	var err error
+	for i := 0; i < 2; i++ {
+		ret := <-ch
+		if ret.err != nil {
+			err = ret.err
+			continue
+		}
+		if i == 0 {
+			// close the slower one
+			go func() {
+				if ret := <-ch; ret.err == nil {
+					ret.pc.Close()
+				}
+			}()
+		}
+		return ret.pc, nil
+	}
+	return nil, err
+}
+
+// connectBy dial peer by tcp or utp and handshake
+func (mgr *resMgr) connectBy(ctx context.Context, r resReq, network string) (*peerConn, error) {
+	c, err := mgr.dial(ctx, r, network)
 	if err != nil {
-		// logging.Error("*GET* read ext header failed" + r.errInfo(err))
-		return
+		return nil, err
 	}
-	logging.Info("*GET* resource %s from %s, pieces=%d, size=%d",
-		r.id.String(), r.addr(), pieces, metaSize)
-	for i := 0; i < pieces; i++ {
-		err = requestPiece(c, metaData, i)
+	if mgr.encryption != mse.PolicyPlaintext {
+		c, err = mgr.encrypt(ctx, c, r, network)
 		if err != nil {
-			logging.Error("*GET* send request piece %d failed"+r.errInfo(err), i)
-			return
+			return nil, err
 		}
 	}
-	pieceData := make([][]byte, pieces)
-	totalLength := func() int {
-		size := 0
-		for i := 0; i < pieces; i++ {
-			size += len(pieceData[i])
+	pc, err := mgr.handshake(c, r)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	pc.network = network
+	if ec, ok := c.(*mse.Conn); ok {
+		pc.encrypted = ec.Encrypted()
+	}
+	return pc, nil
+}
+
+func (mgr *resMgr) dial(ctx context.Context, r resReq, network string) (net.Conn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	var c net.Conn
+	var err error
+	if network == "tcp" {
+		var dialer net.Dialer
+		c, err = dialer.DialContext(dialCtx, "tcp", r.addr())
+	} else {
+		// http://www.bittorrent.org/beps/bep_0029.html
+		if r.ip.To4() == nil && mgr.dht.listen6 == nil {
+			return nil, errors.New("ipv6 not supported")
 		}
-		return size
+		c, err = mgr.dht.utp.Dial(dialCtx, &net.UDPAddr{IP: r.ip, Port: int(r.port)})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newJobConn(ctx, c), nil
+}
+
+// encrypt message stream encryption handshake with info_hash as skey, reconnect
+// by plaintext when peer is not support it and the policy is mse.PolicyPrefer
+// http://wiki.vuze.com/w/Message_Stream_Encryption
+func (mgr *resMgr) encrypt(ctx context.Context, c net.Conn, r resReq, network string) (net.Conn, error) {
+	c.SetDeadline(time.Now().Add(resTimeout))
+	ec, err := mse.Client(c, r.id[:], mgr.encryption)
+	if err == nil {
+		return ec, nil
+	}
+	c.Close()
+	if mgr.encryption != mse.PolicyPrefer {
+		return nil, err
+	}
+	logging.Debug("*GET* encryption not supported, fall back to plaintext" + r.errInfo(err))
+	return mgr.dial(ctx, r, network)
+}
+
+// handshake handshake with peer and read the extended header
+func (mgr *resMgr) handshake(c net.Conn, r resReq) (*peerConn, error) {
+	_, err := c.Write(makeHandshake(r.id))
+	if err != nil {
+		return nil, err
+	}
+	err = readHandshake(c)
+	if err != nil {
+		return nil, err
+	}
+	err = sendExtHeader(c)
+	if err != nil {
+		return nil, err
+	}
+	metaData, metaSize, pieces, yourIP, err := readExtHeader(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(yourIP) == net.IPv4len || len(yourIP) == net.IPv6len {
+		mgr.dht.voteIP(r.ip, net.IP(yourIP))
 	}
+	if metaData == 0 || pieces == 0 {
+		return nil, errors.New("not support ut_metadata")
+	}
+	return &peerConn{
+		Conn:     c,
+		metaData: metaData,
+		metaSize: metaSize,
+		pieces:   pieces,
+	}, nil
+}
+
+// readPiece read data of piece n
+// http://www.bittorrent.org/beps/bep_0009.html#data
+func readPiece(c net.Conn, n int) ([]byte, error) {
 	for {
 		msgID, _, data, err := readMessage(c)
 		if err != nil {
-			// logging.Error("*GET* read peer data failed" + r.errInfo(err))
-			return
+			return nil, err
 		}
 		if msgID != extMsgID {
 			continue
 		}
 		buf := bytes.NewBuffer(data)
 		dec := bencode.NewDecoder(buf)
-		// http://www.bittorrent.org/beps/bep_0009.html#data
 		var hdr struct {
 			Type  byte `bencode:"msg_type"`
 			Piece int  `bencode:"piece"`
@@ -297,44 +646,16 @@ func (mgr *resMgr) get(r resReq, out chan MetaInfo) {
 		}
 		err = dec.Decode(&hdr)
 		if err != nil {
-			logging.Error("*GET* decode data header failed" + r.errInfo(err))
-			return
+			return nil, err
 		}
-		if hdr.Type != extData {
+		if hdr.Piece != n {
 			continue
 		}
-		pieceData[hdr.Piece] = append(pieceData[hdr.Piece], buf.Bytes()...)
-		if totalLength() >= metaSize {
-			var files struct {
-				PieceLength int    `bencode:"piece length"`
-				Length      int    `bencode:"length"`
-				Name        string `bencode:"name"`
-				Files       []struct {
-					Length int      `bencode:"length"`
-					Path   []string `bencode:"path"`
-				} `bencode:"files"`
-			}
-			err = bencode.Decode(bytes.Join(pieceData, nil), &files)
-			if err != nil {
-				logging.Error("*GET* decode data body failed, piece=%d"+r.errInfo(err), hdr.Piece)
-				return
-			}
-			var list []MetaFile
-			for _, file := range files.Files {
-				list = append(list, MetaFile{
-					Path:   file.Path,
-					Length: file.Length,
-				})
-			}
-			out <- MetaInfo{
-				Hash:       r.id.String(),
-				Peer:       r.addr(),
-				Name:       files.Name,
-				Length:     files.Length,
-				MetaLength: metaSize,
-				Files:      list,
-			}
-			return
+		switch hdr.Type {
+		case extData:
+			return buf.Bytes(), nil
+		case extReject:
+			return nil, errRejected
 		}
 	}
 }
@@ -0,0 +1,66 @@
+package dht
+
+import (
+	"net"
+	"testing"
+)
+
+// newTestResMgr resource manager without fetch workers
+func newTestResMgr() *resMgr {
+	cfg := NewConfig()
+	cfg.FetchWorkers = 0
+	return newResMgr(nil, cfg)
+}
+
+func TestResMgrPush(t *testing.T) {
+	mgr := newTestResMgr()
+	defer mgr.close()
+	var id hashType
+	id[0] = 1
+	for i := 1; i <= 3; i++ {
+		mgr.push(resReq{id: id, ip: net.IPv4(1, 1, 1, byte(i)), port: 6881})
+	}
+	if len(mgr.jobs) != 1 || mgr.queue.size() != 1 {
+		t.Fatalf("requests are not merged: jobs=%d, queued=%d", len(mgr.jobs), mgr.queue.size())
+	}
+	if peers := len(mgr.jobs[id].peers); peers != 3 {
+		t.Fatalf("unexpected peers: %d", peers)
+	}
+	if item := mgr.queue.index[id]; item.announces != 3 || len(item.ips) != 3 {
+		t.Fatalf("unexpected announces: %d", item.announces)
+	}
+	// seen info_hash is skipped
+	var seen hashType
+	seen[0] = 2
+	mgr.seen.add(seen)
+	mgr.push(resReq{id: seen, ip: net.IPv4(1, 1, 1, 1), port: 6881})
+	if _, ok := mgr.jobs[seen]; ok || mgr.stats().Skipped != 1 {
+		t.Fatal("seen info_hash is not skipped")
+	}
+}
+
+func TestResMgrShouldFetch(t *testing.T) {
+	mgr := newTestResMgr()
+	defer mgr.close()
+	var asked hashType
+	mgr.shouldFetch = func(hash [20]byte) bool {
+		asked = hash
+		return false
+	}
+	var id hashType
+	id[0] = 1
+	mgr.push(resReq{id: id, ip: net.IPv4(1, 1, 1, 1), port: 6881})
+	popped, _ := mgr.queue.pop()
+	mgr.get(popped, make(chan MetaInfo))
+	if asked != id {
+		t.Fatal("ShouldFetch is not called")
+	}
+	if len(mgr.jobs) != 0 || !mgr.seen.has(id) || mgr.stats().Skipped != 1 {
+		t.Fatal("info_hash is not skipped")
+	}
+	// the next announce is skipped by seen
+	mgr.push(resReq{id: id, ip: net.IPv4(1, 1, 1, 2), port: 6881})
+	if len(mgr.jobs) != 0 || mgr.stats().Skipped != 2 {
+		t.Fatal("info_hash is fetched again")
+	}
+}
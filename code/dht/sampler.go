@@ -0,0 +1,101 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/lwch/magic/code/data"
+	"github.com/lwch/magic/code/logging"
+)
+
+// http://www.bittorrent.org/beps/bep_0051.html
+const maxSamples = 20
+const sampleRepInterval = 300 // seconds
+const maxSampleInterval = 6 * time.Hour
+
+// sampler walk the keyspace and crawl info_hash by sample_infohashes
+type sampler struct {
+	sync.Mutex
+	dht    *DHT
+	cursor uint16               // prefix of next target
+	next   map[string]time.Time // addr => next time to sample
+}
+
+func newSampler(dht *DHT) *sampler {
+	return &sampler{
+		dht:  dht,
+		next: make(map[string]time.Time),
+	}
+}
+
+func (s *sampler) target() hashType {
+	var target hashType
+	rand.Read(target[:])
+	binary.BigEndian.PutUint16(target[:], s.cursor)
+	s.cursor++
+	return target
+}
+
+func (s *sampler) crawl() {
+	s.Lock()
+	target := s.target()
+	s.Unlock()
+	nodes := s.dht.tb.neighbor(target)
+	if s.dht.tb6 != nil {
+		nodes = append(nodes, s.dht.tb6.neighbor(target)...)
+	}
+	now := time.Now()
+	for _, n := range nodes {
+		if n.isBootstrap {
+			continue
+		}
+		key := n.addr.String()
+		s.Lock()
+		next := s.next[key]
+		if now.Before(next) {
+			s.Unlock()
+			continue
+		}
+		// wait for the interval in response
+		s.next[key] = now.Add(lookupTimeout)
+		s.Unlock()
+		n.sendSample(target)
+	}
+}
+
+func (s *sampler) setInterval(key string, interval int) {
+	d := time.Duration(interval) * time.Second
+	if d > maxSampleInterval {
+		d = maxSampleInterval
+	}
+	s.Lock()
+	s.next[key] = time.Now().Add(d)
+	s.Unlock()
+}
+
+func (s *sampler) clearTimeout() {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for key, next := range s.next {
+		if now.After(next) {
+			delete(s.next, key)
+		}
+	}
+}
+
+func (n *node) sendSample(target hashType) {
+	buf, tx, err := data.SampleInfohashesReq(n.dht.localID(), target, n.dht.want())
+	if err != nil {
+		logging.Error("build sample_infohashes packet failed" + n.errInfo(err))
+		return
+	}
+	err = n.dht.send(buf, &n.addr)
+	if err != nil {
+		logging.Error("send sample_infohashes packet failed" + n.errInfo(err))
+		return
+	}
+	n.dht.tx.add(tx, data.TypeSampleInfohashes, emptyHash, target)
+}
@@ -0,0 +1,161 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lwch/bencode"
+	"github.com/lwch/magic/code/data"
+)
+
+// newTestDHT dht without recv and handler goroutines,
+// the packets are sent to remote by node of newTestNode
+func newTestDHT(t *testing.T) (*DHT, *net.UDPConn) {
+	listen, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := NewConfig()
+	cfg.checkDefault()
+	cfg.FetchWorkers = 0
+	dht := &DHT{
+		listen: listen,
+		local:  data.RandID(),
+		tx:     newTXMgr(cfg.TxTimeout),
+		init:   newInitQueue(),
+		token:  newTokenMgr(),
+		peers:  newPeerStore(cfg.MaxPeerHashes, cfg.MaxPeersPerHash, cfg.PeerTimeout),
+		items:  newItemStore(cfg.MaxItems, cfg.ItemTimeout),
+		Out:    make(chan MetaInfo),
+	}
+	dht.nodePool = sync.Pool{
+		New: func() interface{} {
+			return &node{dht: dht}
+		},
+	}
+	dht.tb = newTable(dht, neighborSize, cfg.MaxNodes, false, nil, nil)
+	dht.res = newResMgr(dht, cfg)
+	dht.sample = newSampler(dht)
+	dht.ctx, dht.cancel = context.WithCancel(context.Background())
+	return dht, remote
+}
+
+func closeTestDHT(dht *DHT, remote *net.UDPConn) {
+	dht.cancel()
+	dht.res.close()
+	dht.listen.Close()
+	remote.Close()
+}
+
+func newTestNode(dht *DHT, remote *net.UDPConn) *node {
+	return newNode(dht, data.RandID(), *remote.LocalAddr().(*net.UDPAddr))
+}
+
+// readTestPacket read packet sent to remote, nil when timeout
+func readTestPacket(t *testing.T, remote *net.UDPConn, timeout time.Duration) []byte {
+	buf := make([]byte, 65535)
+	remote.SetReadDeadline(time.Now().Add(timeout))
+	n, _, err := remote.ReadFromUDP(buf)
+	if err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return nil
+		}
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestSamplerTarget(t *testing.T) {
+	s := newSampler(nil)
+	for i := 0; i < 3; i++ {
+		target := s.target()
+		if prefix := binary.BigEndian.Uint16(target[:]); prefix != uint16(i) {
+			t.Fatalf("unexpected prefix: %d", prefix)
+		}
+	}
+	s.setInterval("a", 1e6)
+	if d := time.Until(s.next["a"]); d > maxSampleInterval {
+		t.Fatalf("interval is not limited: %s", d)
+	}
+	s.setInterval("b", 0)
+	time.Sleep(10 * time.Millisecond)
+	s.clearTimeout()
+	if _, ok := s.next["b"]; ok || len(s.next) != 1 {
+		t.Fatal("expired interval is not cleared")
+	}
+}
+
+func TestSamplerCrawl(t *testing.T) {
+	dht, remote := newTestDHT(t)
+	defer closeTestDHT(dht, remote)
+	dht.tb.add(newTestNode(dht, remote))
+	dht.sample.crawl()
+	buf := readTestPacket(t, remote, time.Second)
+	var req data.SampleInfohashesRequest
+	if err := bencode.Decode(buf, &req); err != nil || req.Action != string(data.TypeSampleInfohashes) {
+		t.Fatalf("unexpected request: %q", buf)
+	}
+	if binary.BigEndian.Uint16(req.Data.Target[:]) != 0 {
+		t.Fatal("unexpected target")
+	}
+	// wait for the response
+	dht.sample.crawl()
+	if buf := readTestPacket(t, remote, 200*time.Millisecond); buf != nil {
+		t.Fatalf("node sampled again: %q", buf)
+	}
+}
+
+func TestOnSampleInfohashes(t *testing.T) {
+	dht, remote := newTestDHT(t)
+	defer closeTestDHT(dht, remote)
+	var hash hashType
+	hash[0] = 1
+	dht.peers.add(hash, net.IPv4(1, 2, 3, 4), 6881)
+	n := newTestNode(dht, remote)
+	req, _, err := data.SampleInfohashesReq(n.id, hash, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.onSampleInfohashes(req)
+	var rep data.SampleInfohashesResponse
+	buf := readTestPacket(t, remote, time.Second)
+	if err := bencode.Decode(buf, &rep); err != nil {
+		t.Fatalf("unexpected response: %q", buf)
+	}
+	if rep.Response.Samples != string(hash[:]) || rep.Response.Num != 1 ||
+		rep.Response.Interval != sampleRepInterval {
+		t.Fatalf("unexpected response: %+v", rep.Response)
+	}
+}
+
+func TestOnSampleInfohashesResp(t *testing.T) {
+	dht, remote := newTestDHT(t)
+	defer closeTestDHT(dht, remote)
+	var a, b hashType
+	a[0], b[0] = 1, 2
+	n := newTestNode(dht, remote)
+	rep, err := data.SampleInfohashesRep("aa", n.id, 600, 2, string(a[:])+string(b[:]), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.onSampleInfohashesResp(rep)
+	if d := time.Until(dht.sample.next[n.addr.String()]); d < 590*time.Second {
+		t.Fatalf("interval is not applied: %s", d)
+	}
+	// get_peers of each sample
+	for _, want := range []hashType{a, b} {
+		var req data.GetPeersRequest
+		buf := readTestPacket(t, remote, time.Second)
+		if err := bencode.Decode(buf, &req); err != nil || req.Data.Hash != want {
+			t.Fatalf("unexpected request: %q", buf)
+		}
+	}
+}
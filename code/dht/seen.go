@@ -0,0 +1,75 @@
+package dht
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type seenItem struct {
+	hash     hashType
+	deadline time.Time
+}
+
+// seenSet lru set of info_hash in time window
+type seenSet struct {
+	sync.Mutex
+	list   *list.List // the newest at back
+	index  map[hashType]*list.Element
+	max    int
+	window time.Duration
+}
+
+func newSeenSet(max int, window time.Duration) *seenSet {
+	return &seenSet{
+		list:   list.New(),
+		index:  make(map[hashType]*list.Element),
+		max:    max,
+		window: window,
+	}
+}
+
+func (s *seenSet) add(hash hashType) {
+	s.Lock()
+	defer s.Unlock()
+	deadline := time.Now().Add(s.window)
+	if e, ok := s.index[hash]; ok {
+		e.Value.(*seenItem).deadline = deadline
+		s.list.MoveToBack(e)
+		return
+	}
+	s.index[hash] = s.list.PushBack(&seenItem{hash: hash, deadline: deadline})
+	for s.list.Len() > s.max {
+		s.remove(s.list.Front())
+	}
+}
+
+func (s *seenSet) has(hash hashType) bool {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.index[hash]
+	if !ok {
+		return false
+	}
+	if time.Now().After(e.Value.(*seenItem).deadline) {
+		s.remove(e)
+		return false
+	}
+	return true
+}
+
+func (s *seenSet) remove(e *list.Element) {
+	delete(s.index, s.list.Remove(e).(*seenItem).hash)
+}
+
+func (s *seenSet) clearTimeout() {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for e := s.list.Front(); e != nil; e = s.list.Front() {
+		if now.Before(e.Value.(*seenItem).deadline) {
+			return
+		}
+		s.remove(e)
+	}
+}
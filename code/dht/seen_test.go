@@ -0,0 +1,28 @@
+package dht
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeenSet(t *testing.T) {
+	s := newSeenSet(2, 200*time.Millisecond)
+	var a, b, c hashType
+	a[0], b[0], c[0] = 1, 2, 3
+	s.add(a)
+	s.add(b)
+	// a is refreshed, so b is the oldest
+	s.add(a)
+	s.add(c)
+	if !s.has(a) || s.has(b) || !s.has(c) {
+		t.Fatal("the oldest info_hash should be removed")
+	}
+	time.Sleep(300 * time.Millisecond)
+	if s.has(a) {
+		t.Fatal("info_hash should be expired")
+	}
+	s.clearTimeout()
+	if s.list.Len() != 0 || len(s.index) != 0 {
+		t.Fatalf("%d info_hash left after clear", s.list.Len())
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"container/list"
 	"context"
+	"crypto/rand"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
@@ -14,13 +16,23 @@ import (
 
 const nodeTimeout = time.Minute
 const nodeSendPing = 10 * time.Second
+const maxNodeFailed = 3
+
+// http://www.bittorrent.org/beps/bep_0005.html#routing-table
+const strictNodeTimeout = 15 * time.Minute // questionable after no activity
+const strictPingTimeout = 10 * time.Second // bad when ping is not responded
+
+const bucketRefresh = 15 * time.Minute
+const maxRefreshLookups = 2 // max refresh lookups each time
 
 type bucket struct {
 	sync.RWMutex
-	prefix hashType
-	nodes  *list.List
-	leaf   [2]*bucket
-	bits   int
+	prefix  hashType
+	nodes   *list.List
+	replace *list.List // replacement cache, only used in strict mode
+	leaf    [2]*bucket
+	bits    int
+	updated time.Time // last activity time
 }
 
 func (bk *bucket) isLeaf() bool {
@@ -44,12 +56,97 @@ func (bk *bucket) addNode(n *node, k, maxBits int) bool {
 			return false
 		}
 		target.nodes.PushBack(n)
+		target.updated = time.Now()
 		return true
 	}
 	bk.nodes.PushBack(n)
+	bk.updated = time.Now()
 	return true
 }
 
+// addStrict add node in bep_0005 rules, only the bucket containing local id
+// can be split, the new node is cached when bucket is full
+func (bk *bucket) addStrict(n *node, k, maxBits int, local hashType) bool {
+	bk.Lock()
+	defer bk.Unlock()
+	if e := bk.find(n.id); e != nil {
+		bk.nodes.MoveToBack(e)
+		bk.updated = time.Now()
+		return false
+	}
+	if bk.nodes.Len() < k {
+		bk.nodes.PushBack(n)
+		bk.updated = time.Now()
+		return true
+	}
+	if bk.equalBits(local) && bk.bits < maxBits {
+		bk.split(maxBits)
+		return bk.leaf[n.id.bit(bk.bits)].addStrict(n, k, maxBits, local)
+	}
+	for e := bk.replace.Front(); e != nil; e = e.Next() {
+		if e.Value.(*node).id.equal(n.id) {
+			bk.replace.Remove(e)
+			break
+		}
+	}
+	bk.replace.PushBack(n)
+	if bk.replace.Len() > k {
+		bk.replace.Remove(bk.replace.Front())
+	}
+	// ping the oldest questionable node, it is replaced in clearTimeout when not responded
+	for e := bk.nodes.Front(); e != nil; e = e.Next() {
+		node := e.Value.(*node)
+		if node.questionable() {
+			node.ping()
+			break
+		}
+	}
+	return false
+}
+
+// touch update activity time of bucket, and move the node to the tail in strict mode
+func (bk *bucket) touch(n *node, strict bool) {
+	bk.Lock()
+	defer bk.Unlock()
+	if bk.nodes == nil {
+		return
+	}
+	bk.updated = time.Now()
+	if !strict {
+		return
+	}
+	for e := bk.nodes.Front(); e != nil; e = e.Next() {
+		if e.Value.(*node) == n {
+			bk.nodes.MoveToBack(e)
+			return
+		}
+	}
+}
+
+// promote move nodes from replacement cache to bucket, the newest first
+func (bk *bucket) promote(k int) []*node {
+	var ret []*node
+	for bk.nodes.Len() < k && bk.replace.Len() > 0 {
+		n := bk.replace.Remove(bk.replace.Back()).(*node)
+		bk.nodes.PushBack(n)
+		bk.updated = time.Now()
+		ret = append(ret, n)
+	}
+	return ret
+}
+
+// randomID random id in the prefix range of bucket
+func (bk *bucket) randomID() hashType {
+	var id hashType
+	rand.Read(id[:])
+	for i := 0; i < bk.bits; i++ {
+		bt := i / 8
+		mask := byte(1) << (7 - i%8)
+		id[bt] = id[bt]&^mask | bk.prefix[bt]&mask
+	}
+	return id
+}
+
 func loopSplit(bk *bucket, k, maxBits int) {
 	bk.split(maxBits)
 	if bk.leaf[0] != nil && bk.leaf[0].nodes.Len() >= k {
@@ -61,12 +158,16 @@ func loopSplit(bk *bucket, k, maxBits int) {
 }
 
 func (bk *bucket) exists(id hashType) bool {
+	return bk.find(id) != nil
+}
+
+func (bk *bucket) find(id hashType) *list.Element {
 	for n := bk.nodes.Front(); n != nil; n = n.Next() {
 		if bytes.Equal(n.Value.(*node).id[:], id[:]) {
-			return true
+			return n
 		}
 	}
-	return false
+	return nil
 }
 
 func (bk *bucket) search(id hashType) *bucket {
@@ -109,7 +210,16 @@ func (bk *bucket) split(maxBits int) {
 			bk.leaf[1].nodes.PushBack(node)
 		}
 	}
+	for n := bk.replace.Front(); n != nil; n = n.Next() {
+		node := n.Value.(*node)
+		if bk.leaf[0].equalBits(node.id) {
+			bk.leaf[0].replace.PushBack(node)
+		} else {
+			bk.leaf[1].replace.PushBack(node)
+		}
+	}
 	bk.nodes = nil
+	bk.replace = list.New()
 }
 
 func (bk *bucket) equalBits(id hashType) bool {
@@ -138,7 +248,8 @@ func (bk *bucket) clearTimeout() []*node {
 	for n := bk.nodes.Front(); n != nil; n = n.Next() {
 		element := n.Value.(*node)
 		since := time.Since(element.updated)
-		if !element.isBootstrap && since >= nodeTimeout {
+		if !element.isBootstrap &&
+			(since >= nodeTimeout || element.failed >= maxNodeFailed) {
 			logging.Debug("timeout: %s", element.id.String())
 			removed = append(removed, bk.nodes.Remove(n).(*node))
 			continue
@@ -150,6 +261,33 @@ func (bk *bucket) clearTimeout() []*node {
 	return removed
 }
 
+// clearStrict remove bad nodes and fill the bucket from replacement cache,
+// returns the removed and promoted nodes
+func (bk *bucket) clearStrict(k int) ([]*node, []*node) {
+	bk.Lock()
+	defer bk.Unlock()
+	if bk.nodes == nil {
+		return nil, nil
+	}
+	var removed []*node
+	for n := bk.nodes.Front(); n != nil; {
+		next := n.Next()
+		element := n.Value.(*node)
+		if element.bad() {
+			logging.Debug("bad node: %s", element.id.String())
+			removed = append(removed, bk.nodes.Remove(n).(*node))
+		}
+		n = next
+	}
+	promoted := bk.promote(k)
+	for n := bk.nodes.Front(); n != nil; n = n.Next() {
+		if element := n.Value.(*node); element.questionable() {
+			element.ping()
+		}
+	}
+	return removed, promoted
+}
+
 func (bk *bucket) getNodes() []*node {
 	bk.RLock()
 	defer bk.RUnlock()
@@ -162,9 +300,11 @@ func (bk *bucket) getNodes() []*node {
 
 func newBucket(prefix hashType, bits int) *bucket {
 	return &bucket{
-		prefix: prefix,
-		nodes:  list.New(),
-		bits:   bits,
+		prefix:  prefix,
+		nodes:   list.New(),
+		replace: list.New(),
+		bits:    bits,
+		updated: time.Now(),
 	}
 }
 
@@ -177,12 +317,9 @@ type table struct {
 	size      int
 	maxSize   int
 	maxBits   int
+	strict    bool
 	gen       func() [20]byte
 	filter    func(net.IP, [20]byte) bool
-
-	// runtime
-	ctx    context.Context
-	cancel context.CancelFunc
 }
 
 func bits(n int) int {
@@ -194,7 +331,7 @@ func bits(n int) int {
 	return size
 }
 
-func newTable(dht *DHT, k, max int,
+func newTable(dht *DHT, k, max int, strict bool,
 	gen func() [20]byte,
 	filter func(net.IP, [20]byte) bool) *table {
 	tb := &table{
@@ -204,28 +341,13 @@ func newTable(dht *DHT, k, max int,
 		k:         k,
 		maxBits:   len(emptyHash)*8 - bits(k),
 		maxSize:   max,
+		strict:    strict,
 		gen:       gen,
 		filter:    filter,
 	}
-	tb.ctx, tb.cancel = context.WithCancel(context.Background())
-	go func() {
-		tk := time.Tick(time.Second)
-		for {
-			select {
-			case <-tk:
-				dht.Nodes <- tb.size
-			case <-tb.ctx.Done():
-				return
-			}
-		}
-	}()
 	return tb
 }
 
-func (t *table) close() {
-	t.cancel()
-}
-
 func (t *table) discoverySend(bk *bucket, limit *int) {
 	if *limit <= 0 {
 		return
@@ -238,13 +360,7 @@ func (t *table) discoverySend(bk *bucket, limit *int) {
 			n.Value.(*node).sendDiscovery(t.gen)
 		}
 		*limit -= bk.nodes.Len()
-		t.Lock()
-		for _, node := range bk.clearTimeout() {
-			delete(t.addrIndex, node.addr.String())
-			node.close()
-			t.size--
-		}
-		t.Unlock()
+		t.clearBucket(bk)
 		return
 	}
 	t.dht.even++
@@ -261,6 +377,115 @@ func (t *table) discovery(limit int) {
 	t.discoverySend(t.root, &limit)
 }
 
+// clearBucket remove timeout nodes of bucket from table
+func (t *table) clearBucket(bk *bucket) {
+	var removed, promoted []*node
+	if t.strict {
+		removed, promoted = bk.clearStrict(t.k)
+	} else {
+		removed = bk.clearTimeout()
+	}
+	t.Lock()
+	defer t.Unlock()
+	for _, node := range removed {
+		delete(t.addrIndex, node.addr.String())
+		node.close()
+		t.size--
+	}
+	for _, node := range promoted {
+		t.addrIndex[node.addr.String()] = node
+		t.size++
+	}
+}
+
+// touch update activity time of the bucket which node in,
+// the node is moved to the tail of bucket in strict mode
+func (t *table) touch(n *node) {
+	t.RLock()
+	bk := t.root.search(n.id)
+	t.RUnlock()
+	bk.touch(n, t.strict)
+}
+
+// refresh lookup random id in the buckets which are idle for 15 minutes
+// http://www.bittorrent.org/beps/bep_0005.html#routing-table
+func (t *table) refresh() {
+	var ids []hashType
+	var walk func(bk *bucket)
+	walk = func(bk *bucket) {
+		if len(ids) >= maxRefreshLookups {
+			return
+		}
+		if !bk.isLeaf() {
+			walk(bk.leaf[0])
+			walk(bk.leaf[1])
+			return
+		}
+		bk.Lock()
+		if time.Since(bk.updated) >= bucketRefresh {
+			bk.updated = time.Now()
+			ids = append(ids, bk.randomID())
+		}
+		bk.Unlock()
+	}
+	t.RLock()
+	walk(t.root)
+	t.RUnlock()
+	for _, id := range ids {
+		lk, err := t.dht.newLookup(data.TypeFindNode, id)
+		if err != nil {
+			return
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(t.dht.ctx, time.Minute)
+			defer cancel()
+			lk.run(ctx)
+		}()
+	}
+}
+
+// rekey rebuild the buckets by the new local id in strict mode,
+// the nodes are added again in order of activity
+func (t *table) rekey(local hashType) {
+	if !t.strict {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	var nodes, replace []*node
+	var walk func(bk *bucket)
+	walk = func(bk *bucket) {
+		if bk.leaf[0] != nil || bk.leaf[1] != nil {
+			walk(bk.leaf[0])
+			walk(bk.leaf[1])
+			return
+		}
+		for e := bk.nodes.Front(); e != nil; e = e.Next() {
+			nodes = append(nodes, e.Value.(*node))
+		}
+		for e := bk.replace.Front(); e != nil; e = e.Next() {
+			replace = append(replace, e.Value.(*node))
+		}
+	}
+	walk(t.root)
+	t.root = newBucket(emptyHash, 0)
+	t.addrIndex = make(map[string]*node)
+	t.size = 0
+	for _, n := range append(nodes, replace...) {
+		if t.root.search(n.id).addStrict(n, t.k, t.maxBits, local) {
+			t.addrIndex[n.addr.String()] = n
+			t.size++
+		}
+	}
+}
+
+// count nodes in table
+func (t *table) count() int {
+	t.RLock()
+	defer t.RUnlock()
+	return t.size
+}
+
 func (t *table) add(n *node) bool {
 	if t.size >= t.maxSize {
 		return false
@@ -270,12 +495,24 @@ func (t *table) add(n *node) bool {
 			return false
 		}
 	}
+	if t.dht.enforceSecure && !n.isBootstrap && !checkSecureID(n.addr.IP, n.id) {
+		return false
+	}
+	// bootstrap nodes are only used as lookup seeds in strict mode
+	if t.strict && t.dht.isBootstrapAddr(n.addr) {
+		return false
+	}
 	t.Lock()
 	defer t.Unlock()
 	next := t.root
 	for idx := 0; idx < len(n.id)*8; idx++ {
 		if next.isLeaf() {
-			ok := next.addNode(n, t.k, t.maxBits)
+			var ok bool
+			if t.strict {
+				ok = next.addStrict(n, t.k, t.maxBits, t.dht.localID())
+			} else {
+				ok = next.addNode(n, t.k, t.maxBits)
+			}
 			if ok {
 				t.addrIndex[n.addr.String()] = n
 				t.size++
@@ -302,6 +539,16 @@ func (t *table) remove(n *node) {
 		bk.nodes.Remove(nd)
 		node.close()
 		t.size--
+		break
+	}
+	if t.strict {
+		bk.Lock()
+		promoted := bk.promote(t.k)
+		bk.Unlock()
+		for _, node := range promoted {
+			t.addrIndex[node.addr.String()] = node
+			t.size++
+		}
 	}
 }
 
@@ -314,14 +561,10 @@ func (t *table) findAddr(addr net.Addr) *node {
 	}
 	// free node
 	if t.dht.even%2 == 0 {
+		t.RLock()
 		bk := t.root.search(data.id)
-		t.Lock()
-		for _, node := range bk.clearTimeout() {
-			delete(t.addrIndex, node.addr.String())
-			node.close()
-			t.size--
-		}
-		t.Unlock()
+		t.RUnlock()
+		t.clearBucket(bk)
 	}
 	t.dht.even++
 	return data
@@ -337,13 +580,7 @@ func (t *table) findID(id hashType) *node {
 		if t.dht.even%2 == 0 {
 			return
 		}
-		t.Lock()
-		for _, node := range bk.clearTimeout() {
-			delete(t.addrIndex, node.addr.String())
-			node.close()
-			t.size--
-		}
-		t.Unlock()
+		t.clearBucket(bk)
 	}()
 	for n := bk.nodes.Front(); n != nil; n = n.Next() {
 		node := n.Value.(*node)
@@ -354,17 +591,70 @@ func (t *table) findID(id hashType) *node {
 	return nil
 }
 
+// neighbor the k closest nodes of id which are not bad
 func (t *table) neighbor(id hashType) []*node {
 	t.RLock()
 	bk := t.root.search(id)
 	t.RUnlock()
 
-	t.Lock()
-	for _, node := range bk.clearTimeout() {
-		delete(t.addrIndex, node.addr.String())
-		node.close()
-		t.size--
+	t.clearBucket(bk)
+	return t.closest(id, t.k, goodNode)
+}
+
+func goodNode(n *node) bool {
+	return !n.bad()
+}
+
+// closest the k nodes with smallest xor distance to id, filter is optional,
+// the subtree on the same side of id is always closer than the other side,
+// so buckets are walked in depth first order and stopped when k nodes found
+func (t *table) closest(id hashType, k int, filter func(*node) bool) []*node {
+	t.RLock()
+	defer t.RUnlock()
+	ret := make([]*node, 0, k)
+	var walk func(bk *bucket)
+	walk = func(bk *bucket) {
+		if len(ret) >= k {
+			return
+		}
+		if !bk.isLeaf() {
+			near := id.bit(bk.bits)
+			walk(bk.leaf[near])
+			walk(bk.leaf[near^1])
+			return
+		}
+		nodes := bk.getNodes()
+		sort.Slice(nodes, func(i, j int) bool {
+			return id.closer(nodes[i].id, nodes[j].id)
+		})
+		for _, n := range nodes {
+			if len(ret) >= k {
+				return
+			}
+			if filter != nil && !filter(n) {
+				continue
+			}
+			ret = append(ret, n)
+		}
 	}
-	t.Unlock()
-	return bk.getNodes()
+	walk(t.root)
+	return ret
+}
+
+// allNodes all nodes in table
+func (t *table) allNodes() []*node {
+	t.RLock()
+	defer t.RUnlock()
+	ret := make([]*node, 0, t.size)
+	var walk func(bk *bucket)
+	walk = func(bk *bucket) {
+		if bk.isLeaf() {
+			ret = append(ret, bk.getNodes()...)
+			return
+		}
+		walk(bk.leaf[0])
+		walk(bk.leaf[1])
+	}
+	walk(t.root)
+	return ret
 }
@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"sort"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/lwch/magic/code/data"
 )
 
 func init() {
@@ -20,7 +23,7 @@ func TestTable(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	table := newTable(dht, 8, 1000000, nil, nil)
+	table := newTable(dht, 8, 1000000, false, nil, nil)
 	var id hashType
 	for i := 0; i < 10000; i++ {
 		rand.Read(id[:])
@@ -51,3 +54,160 @@ func printTable(bk *bucket, dir string) (hashType, int, int) {
 		bk.prefix.String(), dir, bk.bits, strings.Join(ids, ","))
 	return bk.prefix, bk.bits, bk.nodes.Len()
 }
+
+func TestStrictTable(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Listen = 16881
+	dht, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dht.Close()
+	table := newTable(dht, 8, 1000000, true, nil, nil)
+	var id hashType
+	for i := 0; i < 10000; i++ {
+		rand.Read(id[:])
+		table.add(newNode(dht, id, net.UDPAddr{}))
+	}
+	checkStrict(t, table, dht.local)
+}
+
+// checkStrict check only the buckets containing local id are split
+func checkStrict(t *testing.T, table *table, local hashType) {
+	var walk func(bk *bucket)
+	walk = func(bk *bucket) {
+		if bk.isLeaf() {
+			if bk.nodes.Len() > 8 || bk.replace.Len() > 8 {
+				t.Fatalf("bucket %s overflow", bk.prefix.String())
+			}
+			return
+		}
+		if !bk.equalBits(local) {
+			t.Fatalf("bucket %s not contains local id is split", bk.prefix.String())
+		}
+		walk(bk.leaf[0])
+		walk(bk.leaf[1])
+	}
+	walk(table.root)
+	if table.size > 160*8 {
+		t.Fatalf("unexpected table size: %d", table.size)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Listen = 16885
+	cfg.DisableIPv6 = true
+	cfg.StrictTable = true
+	cfg.SecureID = true
+	dht, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dht.Close()
+	var id hashType
+	for i := 0; i < 10000; i++ {
+		rand.Read(id[:])
+		dht.tb.add(newNode(dht, id, net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: i + 1}))
+	}
+	local := dht.localID()
+	// node id is not changed by ipv6 address
+	dht.setExternalIP(net.ParseIP("2001:db8::1"))
+	if dht.localID() != local {
+		t.Fatal("node id changed by ipv6 address")
+	}
+	ip := net.ParseIP("124.31.75.21")
+	dht.setExternalIP(ip)
+	if dht.localID() == local || !checkSecureID(ip, dht.localID()) {
+		t.Fatal("node id not changed by external ip")
+	}
+	if dht.tb.size == 0 {
+		t.Fatal("empty table after rekey")
+	}
+	checkStrict(t, dht.tb, dht.localID())
+}
+
+func TestClosest(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Listen = 16882
+	dht, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dht.Close()
+	table := newTable(dht, 8, 1000000, false, nil, nil)
+	var id hashType
+	for i := 0; i < 10000; i++ {
+		rand.Read(id[:])
+		table.add(newNode(dht, id, net.UDPAddr{}))
+	}
+	var target hashType
+	rand.Read(target[:])
+	all := table.allNodes()
+	sort.Slice(all, func(i, j int) bool {
+		return target.closer(all[i].id, all[j].id)
+	})
+	nodes := table.closest(target, 8, nil)
+	if len(nodes) != 8 {
+		t.Fatalf("unexpected count: %d", len(nodes))
+	}
+	for i, n := range nodes {
+		if !n.id.equal(all[i].id) {
+			t.Fatalf("unexpected node at %d: %s, want %s", i, n.id.String(), all[i].id.String())
+		}
+	}
+}
+
+func TestBucketRandomID(t *testing.T) {
+	var prefix hashType
+	for bits := 0; bits < 150; bits++ {
+		rand.Read(prefix[:])
+		bk := newBucket(prefix, bits)
+		id := bk.randomID()
+		if !bk.equalBits(id) {
+			t.Fatalf("random id %s not in bucket %s/%d", id.String(), prefix.String(), bits)
+		}
+		// bits after prefix must be random
+		next := bk.randomID()
+		if !bk.equalBits(next) {
+			t.Fatalf("random id %s not in bucket %s/%d", next.String(), prefix.String(), bits)
+		}
+		if bits <= 128 && id == next {
+			t.Fatalf("random id %s generated twice in bucket %s/%d", id.String(), prefix.String(), bits)
+		}
+	}
+	// every byte is random without prefix
+	bk := newBucket(prefix, 0)
+	first := make(map[byte]bool)
+	for i := 0; i < 32; i++ {
+		first[bk.randomID()[0]] = true
+	}
+	if len(first) == 1 {
+		t.Fatal("first byte of random id is fixed")
+	}
+}
+
+func TestStrictBootstrap(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Listen = 16886
+	cfg.DisableIPv6 = true
+	cfg.StrictTable = true
+	dht, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dht.Close()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	dht.bootstrap = []*net.UDPAddr{addr}
+	if dht.tb.add(newNode(dht, data.RandID(), *addr)) {
+		t.Fatal("bootstrap node added to strict table")
+	}
+	// the bootstrap nodes are used as seeds
+	lk, err := dht.newLookup(data.TypeFindNode, dht.localID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lk.nodes) != 1 || lk.nodes[0].addr.String() != addr.String() {
+		t.Fatalf("unexpected lookup seeds: %d", len(lk.nodes))
+	}
+}
@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+const tokenRotate = 5 * time.Minute
+
+// tokenMgr generate and verify get_peers token,
+// token is the hmac of requester ip with a secret rotated every 5 minutes,
+// tokens created by the previous secret are still accepted
+// http://www.bittorrent.org/beps/bep_0005.html#announce-peer
+type tokenMgr struct {
+	sync.Mutex
+	secret  [2][20]byte // current, previous
+	rotated time.Time
+}
+
+func newTokenMgr() *tokenMgr {
+	mgr := &tokenMgr{rotated: time.Now()}
+	rand.Read(mgr.secret[0][:])
+	rand.Read(mgr.secret[1][:])
+	return mgr
+}
+
+// rotate is lazy, both secrets are replaced when idle for two periods
+func (mgr *tokenMgr) rotate() {
+	since := time.Since(mgr.rotated)
+	if since < tokenRotate {
+		return
+	}
+	if since >= 2*tokenRotate {
+		rand.Read(mgr.secret[1][:])
+	} else {
+		mgr.secret[1] = mgr.secret[0]
+	}
+	rand.Read(mgr.secret[0][:])
+	mgr.rotated = time.Now()
+}
+
+func makeToken(secret [20]byte, ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	mac := hmac.New(sha1.New, secret[:])
+	mac.Write(ip)
+	return string(mac.Sum(nil))
+}
+
+func (mgr *tokenMgr) gen(ip net.IP) string {
+	mgr.Lock()
+	defer mgr.Unlock()
+	mgr.rotate()
+	return makeToken(mgr.secret[0], ip)
+}
+
+func (mgr *tokenMgr) verify(ip net.IP, token string) bool {
+	mgr.Lock()
+	defer mgr.Unlock()
+	mgr.rotate()
+	for _, secret := range mgr.secret {
+		if hmac.Equal([]byte(makeToken(secret, ip)), []byte(token)) {
+			return true
+		}
+	}
+	return false
+}
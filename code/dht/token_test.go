@@ -0,0 +1,33 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	mgr := newTokenMgr()
+	ip := net.ParseIP("1.2.3.4")
+	token := mgr.gen(ip)
+	if !mgr.verify(ip, token) {
+		t.Fatal("verify token failed")
+	}
+	if mgr.verify(net.ParseIP("4.3.2.1"), token) {
+		t.Fatal("token of other ip is accepted")
+	}
+	// token of previous secret is accepted
+	mgr.rotated = time.Now().Add(-tokenRotate)
+	if mgr.gen(ip) == token {
+		t.Fatal("secret is not rotated")
+	}
+	if !mgr.verify(ip, token) {
+		t.Fatal("token of previous secret is rejected")
+	}
+	// idle for two periods
+	token = mgr.gen(ip)
+	mgr.rotated = time.Now().Add(-2 * tokenRotate)
+	if mgr.verify(ip, token) {
+		t.Fatal("expired token is accepted")
+	}
+}
@@ -0,0 +1,84 @@
+package dht
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lwch/magic/code/data"
+)
+
+var errInvalidHash = errors.New("invalid info_hash")
+
+// EncodeTorrent encode .torrent file by raw info dictionary, announce is the
+// tiers of tracker url and creation date is omitted when created is zero
+// http://www.bittorrent.org/beps/bep_0003.html#metainfo-files
+// http://www.bittorrent.org/beps/bep_0012.html
+func EncodeTorrent(info []byte, announce [][]string, created time.Time) []byte {
+	dict := data.RawDict{"info": info}
+	var tiers [][]byte
+	for _, tier := range announce {
+		var list [][]byte
+		for _, tracker := range tier {
+			if len(tracker) == 0 {
+				continue
+			}
+			if _, ok := dict["announce"]; !ok {
+				dict["announce"] = data.EncodeString(tracker)
+			}
+			list = append(list, data.EncodeString(tracker))
+		}
+		if len(list) > 0 {
+			tiers = append(tiers, data.EncodeList(list...))
+		}
+	}
+	if len(tiers) > 0 {
+		dict["announce-list"] = data.EncodeList(tiers...)
+	}
+	if !created.IsZero() {
+		dict["creation date"] = data.EncodeInt(created.Unix())
+	}
+	return dict.Encode()
+}
+
+// Torrent encode .torrent file of meta info
+func (info *MetaInfo) Torrent(announce [][]string, created time.Time) []byte {
+	return EncodeTorrent(info.Raw, announce, created)
+}
+
+// TorrentPath .torrent file path sharded by info_hash, dir/ab/cd/abcd...ef.torrent
+func TorrentPath(dir, hash string) (string, error) {
+	hash = strings.ToLower(hash)
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) < 4 {
+		return "", errInvalidHash
+	}
+	return filepath.Join(dir, hash[:2], hash[2:4], hash+".torrent"), nil
+}
+
+// SaveTorrent save .torrent file to the sharded directory, returns the file path
+func SaveTorrent(dir, hash string, torrent []byte) (string, error) {
+	path, err := TorrentPath(dir, hash)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+	// write to temporary file and rename, never leave a half written file
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, torrent, 0644)
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, nil
+}
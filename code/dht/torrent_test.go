@@ -0,0 +1,50 @@
+package dht
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEncodeTorrent(t *testing.T) {
+	info := []byte("d6:lengthi1e4:name1:a12:piece lengthi16384e6:pieces20:xxxxxxxxxxxxxxxxxxxxe")
+	torrent := EncodeTorrent(info, nil, time.Time{})
+	if string(torrent) != "d4:info"+string(info)+"e" {
+		t.Fatalf("unexpected torrent: %s", torrent)
+	}
+	torrent = EncodeTorrent(info, [][]string{{"udp://a", ""}, {}, {"udp://b", "udp://c"}}, time.Unix(1, 0))
+	want := "d8:announce7:udp://a13:announce-listll7:udp://ael7:udp://b7:udp://cee" +
+		"13:creation datei1e4:info" + string(info) + "e"
+	if string(torrent) != want {
+		t.Fatalf("unexpected torrent: %s", torrent)
+	}
+}
+
+func TestSaveTorrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := SaveTorrent(dir, "../../x", []byte("de")); err != errInvalidHash {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hash := "ABCDEF0123456789abcdef0123456789abcdef01"
+	path, err := SaveTorrent(dir, hash, []byte("de"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dir, "ab", "cd", "abcdef0123456789abcdef0123456789abcdef01.torrent") {
+		t.Fatalf("unexpected path: %s", path)
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, []byte("de")) {
+		t.Fatalf("unexpected content: %s", buf)
+	}
+}
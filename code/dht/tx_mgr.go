@@ -21,6 +21,7 @@ type tx struct {
 	hash     hashType     // get_peers.info_hash
 	remote   hashType     // find_node.target
 	t        data.ReqType // request type
+	lk       *lookup      // iterative lookup which sent the request
 	deadline time.Time
 }
 
@@ -55,7 +56,25 @@ func txHash(tx string) uint {
 }
 
 func (mgr *txMgr) add(id string, t data.ReqType, hash hashType, remote hashType) {
-	list := mgr.list[txHash(id)%txBucketSize]
+	mgr.push(tx{
+		id:     id,
+		hash:   hash,
+		remote: remote,
+		t:      t,
+	})
+}
+
+func (mgr *txMgr) addLookup(id string, t data.ReqType, lk *lookup) {
+	mgr.push(tx{
+		id:   id,
+		hash: lk.target,
+		t:    t,
+		lk:   lk,
+	})
+}
+
+func (mgr *txMgr) push(t tx) {
+	list := mgr.list[txHash(t.id)%txBucketSize]
 	mgr.clearTimeout(list)
 	if list.Len() >= maxTxBucketSize {
 		mgr.Lock()
@@ -63,14 +82,9 @@ func (mgr *txMgr) add(id string, t data.ReqType, hash hashType, remote hashType)
 		mgr.count--
 		mgr.Unlock()
 	}
+	t.deadline = time.Now().Add(mgr.timeout)
 	mgr.Lock()
-	list.PushBack(tx{
-		id:       id,
-		hash:     hash,
-		remote:   remote,
-		t:        t,
-		deadline: time.Now().Add(mgr.timeout),
-	})
+	list.PushBack(t)
 	mgr.count++
 	mgr.Unlock()
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lwch/magic/code/dht"
+	"github.com/lwch/runtime"
+)
+
+// exportTorrent magic export-torrent [flags] <hash>...
+func exportTorrent(args []string) {
+	set := flag.NewFlagSet("export-torrent", flag.ExitOnError)
+	dbAddr := set.String("db", "data.db", "sqlite save dir")
+	dir := set.String("dir", "torrents", "output dir sharded by info_hash")
+	trackers := set.String("tracker", "", "tracker list of .torrent file, separated by comma")
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "Usage: %s export-torrent [flags] <hash>...\n", os.Args[0])
+		set.PrintDefaults()
+	}
+	set.Parse(args)
+	if set.NArg() == 0 {
+		set.Usage()
+		os.Exit(2)
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+*dbAddr+"?cache=shared")
+	runtime.Assert(err)
+	defer db.Close()
+	dbInit(db)
+
+	announce := announceList(*trackers)
+	var failed bool
+	for _, hash := range set.Args() {
+		hash = strings.ToLower(hash)
+		var created int64
+		var info []byte
+		err := db.QueryRow("SELECT created, info FROM resource WHERE hash=?", hash).Scan(&created, &info)
+		if err == sql.ErrNoRows {
+			fmt.Fprintf(os.Stderr, "%s: not found\n", hash)
+			failed = true
+			continue
+		}
+		runtime.Assert(err)
+		if len(info) == 0 {
+			// saved before info dictionary was kept
+			fmt.Fprintf(os.Stderr, "%s: no info dictionary\n", hash)
+			failed = true
+			continue
+		}
+		path, err := dht.SaveTorrent(*dir, hash, dht.EncodeTorrent(info, announce, time.Unix(created, 0)))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", hash, err)
+			failed = true
+			continue
+		}
+		fmt.Println(path)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
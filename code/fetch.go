@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lwch/magic/code/dht"
+	"github.com/lwch/magic/code/logging"
+	"github.com/lwch/runtime"
+)
+
+const minFetchNodes = 8 // wait for bootstrap before lookup
+const bootstrapTimeout = 30 * time.Second
+
+// fetch magic fetch [flags] <magnet|hash>
+func fetch(args []string) {
+	set := flag.NewFlagSet("fetch", flag.ExitOnError)
+	listen := set.Uint("listen", 0, "listen port, random when 0")
+	nodesFile := set.String("nodes", "", "routing table file for fast bootstrap, such as nodes.json of spider, it is never overwritten")
+	timeout := set.Duration("timeout", 5*time.Minute, "fetch timeout")
+	format := set.String("format", "json", "output format, json or torrent")
+	encryption := set.String("encryption", "prefer", "encryption of fetching metadata: plaintext, prefer or require")
+	trackers := set.String("tracker", "", "tracker list of .torrent file, separated by comma, default is tr in magnet link")
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "Usage: %s fetch [flags] <magnet|hash>\n", os.Args[0])
+		set.PrintDefaults()
+	}
+	set.Parse(args)
+	if set.NArg() != 1 || (*format != "json" && *format != "torrent") {
+		set.Usage()
+		os.Exit(2)
+	}
+	// keep stdout for output
+	log.SetOutput(os.Stderr)
+
+	var m *dht.Magnet
+	var err error
+	if strings.HasPrefix(set.Arg(0), "magnet:") {
+		m, err = dht.ParseMagnet(set.Arg(0))
+	} else {
+		m = new(dht.Magnet)
+		m.Hash, err = dht.ParseHash(set.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintf(set.Output(), "invalid magnet or hash %q: %v\n", set.Arg(0), err)
+		os.Exit(2)
+	}
+	var peers []net.Addr
+	for _, pe := range m.Peers {
+		addr, err := net.ResolveTCPAddr("tcp", pe)
+		if err != nil {
+			logging.Error("resolve peer address %s failed: %v", pe, err)
+			continue
+		}
+		peers = append(peers, addr)
+	}
+
+	cfg := dht.NewConfig()
+	cfg.Listen = uint16(*listen)
+	if cfg.Listen == 0 {
+		cfg.Listen = uint16(10000 + rand.Intn(50000))
+	}
+	cfg.NodesFile = *nodesFile
+	cfg.NodesReadOnly = true
+	cfg.FetchEncryption = parseEncryption(*encryption)
+	// only fetch the given info_hash
+	cfg.ShouldFetch = func([20]byte) bool {
+		return false
+	}
+	mgr, err := dht.New(cfg)
+	runtime.Assert(err)
+	mgr.Discovery(bootstrapAddrs())
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	// the peers in magnet link are tried even if bootstrap is failed
+	waitBootstrap(ctx, mgr)
+	go func() {
+		for range mgr.Nodes {
+		}
+	}()
+	info, err := mgr.Fetch(ctx, m.Hash, peers...)
+	mgr.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fetch %x failed: %v\n", m.Hash, err)
+		os.Exit(1)
+	}
+	if *format == "torrent" {
+		announce := announceList(*trackers)
+		if len(announce) == 0 {
+			for _, tr := range m.Trackers {
+				announce = append(announce, []string{tr})
+			}
+		}
+		os.Stdout.Write(info.Torrent(announce, time.Now()))
+		return
+	}
+	data, _ := json.Marshal(info)
+	fmt.Println(string(data))
+}
+
+// waitBootstrap wait for enough nodes in routing table
+func waitBootstrap(ctx context.Context, mgr *dht.DHT) {
+	wait := time.NewTimer(bootstrapTimeout)
+	defer wait.Stop()
+	for {
+		select {
+		case nodes := <-mgr.Nodes:
+			if nodes >= minFetchNodes {
+				return
+			}
+		case <-wait.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -2,38 +2,76 @@ package main
 
 import (
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"math/rand"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/lwch/magic/code/dht"
 	"github.com/lwch/magic/code/logging"
+	"github.com/lwch/magic/code/mse"
 	"github.com/lwch/runtime"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var bootstrapAddrs []*net.UDPAddr
+var bootstrapRouters = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
-	for _, addr := range []string{
-		"router.bittorrent.com:6881",
-		"router.utorrent.com:6881",
-		"dht.transmissionbt.com:6881",
-	} {
-		addr, err := net.ResolveUDPAddr("udp", addr)
-		runtime.Assert(err)
-		bootstrapAddrs = append(bootstrapAddrs, addr)
+}
+
+func bootstrapAddrs() []*net.UDPAddr {
+	var ret []*net.UDPAddr
+	for _, addr := range bootstrapRouters {
+		udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+		if err != nil {
+			logging.Error("resolve bootstrap address %s failed: %v", addr, err)
+			continue
+		}
+		ret = append(ret, udpAddr)
+		// not all routers have ipv6 address
+		udpAddr, err = net.ResolveUDPAddr("udp6", addr)
+		if err == nil {
+			ret = append(ret, udpAddr)
+		}
 	}
+	return ret
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export-torrent":
+			exportTorrent(os.Args[2:])
+			return
+		case "fetch":
+			fetch(os.Args[2:])
+			return
+		}
+	}
 	listen := flag.Uint("listen", 6881, "listen port")
 	minNodes := flag.Int("min-nodes", 100000, "minimum nodes in descovery")
 	maxNodes := flag.Int("max-nodes", 1000000, "maximum nodes in descovery")
 	dbAddr := flag.String("db", "data.db", "sqlite save dir")
+	nodesFile := flag.String("nodes", "nodes.json", "routing table save file")
+	idFile := flag.String("id", "node.id", "node id save file")
+	secureID := flag.Bool("secure-id", false, "derive node id from external ip(bep_0042)")
+	sample := flag.Bool("sample", false, "crawl info_hash by sample_infohashes(bep_0051)")
+	strictTable := flag.Bool("strict-table", false, "use bep_0005 routing table instead of spider table")
+	encryption := flag.String("encryption", "plaintext", "encryption of fetching metadata: plaintext, prefer or require")
+	transport := flag.String("transport", "parallel", "transport of fetching metadata: parallel, tcp-first, utp-first, tcp or utp(bep_0029)")
+	torrentDir := flag.String("torrent-dir", "", "save .torrent file to dir sharded by info_hash, empty to disable")
+	trackers := flag.String("tracker", "", "tracker list of saved .torrent file, separated by comma")
 	flag.Parse()
 
 	db, err := sql.Open("sqlite3", "file:"+*dbAddr+"?cache=shared")
@@ -41,7 +79,62 @@ func main() {
 	defer db.Close()
 	dbInit(db)
 
-	run(uint16(*listen), *minNodes, *maxNodes, db)
+	cfg := dht.NewConfig()
+	cfg.Listen = uint16(*listen)
+	cfg.MinNodes = *minNodes
+	cfg.MaxNodes = *maxNodes
+	cfg.NodesFile = *nodesFile
+	cfg.IDFile = *idFile
+	cfg.SecureID = *secureID
+	cfg.Sample = *sample
+	cfg.StrictTable = *strictTable
+	cfg.FetchTransport = parseTransport(*transport)
+	cfg.FetchEncryption = parseEncryption(*encryption)
+	run(cfg, db, *torrentDir, announceList(*trackers))
+}
+
+func parseTransport(str string) dht.Transport {
+	switch str {
+	case "parallel":
+		return dht.TransportParallel
+	case "tcp-first":
+		return dht.TransportTCPFirst
+	case "utp-first":
+		return dht.TransportUTPFirst
+	case "tcp":
+		return dht.TransportTCP
+	case "utp":
+		return dht.TransportUTP
+	}
+	logging.Error("invalid transport: %s", str)
+	os.Exit(2)
+	return dht.TransportParallel
+}
+
+func parseEncryption(str string) mse.Policy {
+	switch str {
+	case "plaintext":
+		return mse.PolicyPlaintext
+	case "prefer":
+		return mse.PolicyPrefer
+	case "require":
+		return mse.PolicyRequire
+	}
+	logging.Error("invalid encryption: %s", str)
+	os.Exit(2)
+	return mse.PolicyPlaintext
+}
+
+// announceList one tracker per tier
+func announceList(trackers string) [][]string {
+	var ret [][]string
+	for _, tracker := range strings.Split(trackers, ",") {
+		tracker = strings.TrimSpace(tracker)
+		if len(tracker) > 0 {
+			ret = append(ret, []string{tracker})
+		}
+	}
+	return ret
 }
 
 func dbInit(db *sql.DB) {
@@ -55,22 +148,84 @@ func dbInit(db *sql.DB) {
 		hash text NOT NULL,
 		name text NOT NULL,
 		length integer,
-		data text NOT NULL
+		data text NOT NULL,
+		info blob,
+		magnet text
 	)`)
 	exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_hash ON resource(hash)`)
+	// upgrade database created by old version
+	addColumn := func(column, def string) bool {
+		rows, err := db.Query("SELECT " + column + " FROM resource LIMIT 0")
+		if err == nil {
+			rows.Close()
+			return false
+		}
+		exec("ALTER TABLE resource ADD COLUMN " + column + " " + def)
+		return true
+	}
+	addColumn("info", "blob")
+	if addColumn("magnet", "text") {
+		exec(`UPDATE resource SET magnet='magnet:?xt=urn:btih:'||hash`)
+	}
+	// truncated v2 info_hash, hybrid torrent may be announced by it
+	addColumn("hash2", "text")
+	exec(`CREATE INDEX IF NOT EXISTS idx_hash2 ON resource(hash2)`)
 }
 
-func run(listen uint16, minNodes, maxNodes int, db *sql.DB) {
-	cfg := dht.NewConfig()
-	cfg.Listen = listen
-	cfg.MinNodes = minNodes
-	cfg.MaxNodes = maxNodes
+// truncatedV2 the first 20 bytes of v2 info_hash in hex, nil for v1 only torrent
+func truncatedV2(info dht.MetaInfo) interface{} {
+	if len(info.HashV2) < 40 {
+		return nil
+	}
+	return info.HashV2[:40]
+}
+
+func run(cfg *dht.Config, db *sql.DB, torrentDir string, announce [][]string) {
+	cfg.ShouldFetch = func(hash [20]byte) bool {
+		var cnt int
+		str := hex.EncodeToString(hash[:])
+		err := db.QueryRow("SELECT COUNT(*) FROM resource WHERE hash=? OR hash2=?",
+			str, str).Scan(&cnt)
+		if err != nil {
+			logging.Error("query resource failed, hash=%x, err=%v", hash, err)
+			return true
+		}
+		return cnt == 0
+	}
 	cfg.NodeFilter = func(ip net.IP, id [20]byte) bool {
 		return false
 	}
 	mgr, err := dht.New(cfg)
 	runtime.Assert(err)
-	mgr.Discovery(bootstrapAddrs)
+	mgr.Discovery(bootstrapAddrs())
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+		<-ch
+		// save routing table
+		mgr.Close()
+		// deferred close is skipped by os.Exit
+		db.Close()
+		os.Exit(0)
+	}()
+	go func() {
+		// SIGUSR1: print failed info_hash, SIGUSR2: clear failed info_hash
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGUSR1, syscall.SIGUSR2)
+		for sig := range ch {
+			if sig == syscall.SIGUSR2 {
+				mgr.ClearFailed()
+				logging.Info("failed info_hash cleared")
+				continue
+			}
+			list := mgr.FailedHashes()
+			for _, item := range list {
+				logging.Info("failed: hash=%s, attempts=%d, reason=%s, next_retry=%s",
+					item.Hash, item.Attempts, item.Reason, item.NextRetry.Format(time.RFC3339))
+			}
+			logging.Info("%d failed info_hash", len(list))
+		}
+	}()
 	var nodes int
 	go func() {
 		for count := range mgr.Nodes {
@@ -80,7 +235,10 @@ func run(listen uint16, minNodes, maxNodes int, db *sql.DB) {
 	go func() {
 		for {
 			time.Sleep(10 * time.Second)
-			logging.Info("%d nodes", nodes)
+			stats := mgr.Stats()
+			logging.Info("%d nodes, fetch: queued=%d, in_flight=%d, succeeded=%d, failed=%d, dropped=%d, skipped=%d, tcp=%d, utp=%d, encrypted=%d",
+				nodes, stats.Queued, stats.InFlight, stats.Succeeded, stats.Failed, stats.Dropped, stats.Skipped,
+				stats.TCP, stats.UTP, stats.Encrypted)
 		}
 	}()
 	for info := range mgr.Out {
@@ -92,10 +250,19 @@ func run(listen uint16, minNodes, maxNodes int, db *sql.DB) {
 				length += file.Length
 			}
 		}
-		_, err = db.Exec("INSERT OR IGNORE INTO resource(created, hash, name, length, data) VALUES(?, ?, ?, ?, ?)",
-			time.Now().Unix(), info.Hash, info.Name, length, string(data))
+		now := time.Now()
+		// hash2 of the resource saved by old version is filled when fetched again
+		_, err = db.Exec("INSERT INTO resource(created, hash, hash2, name, length, data, info, magnet) VALUES(?, ?, ?, ?, ?, ?, ?, ?) "+
+			"ON CONFLICT(hash) DO UPDATE SET hash2=excluded.hash2",
+			now.Unix(), info.Hash, truncatedV2(info), info.Name, length, string(data), info.Raw, info.Magnet)
 		if err != nil {
 			logging.Error("log resource failed, hash=%s, err=%v", info.Hash, err)
 		}
+		if len(torrentDir) > 0 {
+			_, err = dht.SaveTorrent(torrentDir, info.Hash, info.Torrent(announce, now))
+			if err != nil {
+				logging.Error("save torrent failed, hash=%s, err=%v", info.Hash, err)
+			}
+		}
 	}
 }
@@ -0,0 +1,379 @@
+package mse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	mrand "math/rand"
+	"net"
+)
+
+// Policy encryption policy of peer connection
+type Policy int
+
+const (
+	// PolicyPlaintext plaintext only
+	PolicyPlaintext Policy = iota
+	// PolicyPrefer prefer rc4 encryption, fall back to plaintext
+	PolicyPrefer
+	// PolicyRequire rc4 encryption only
+	PolicyRequire
+)
+
+// crypto_provide and crypto_select
+const (
+	cryptoPlaintext = uint32(1)
+	cryptoRC4       = uint32(2)
+)
+
+const keySize = 96 // 768 bits
+const maxPad = 512
+
+var errNoSKey = errors.New("mse: skey not found")
+var errNoVC = errors.New("mse: verification constant not found")
+var errNoReq1 = errors.New("mse: req1 not found")
+var errInvalidKey = errors.New("mse: invalid public key")
+var errCrypto = errors.New("mse: no supported crypto method")
+
+// http://wiki.vuze.com/w/Message_Stream_Encryption
+var prime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+	"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+	"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+	"E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+var generator = big.NewInt(2)
+
+// vc verification constant
+var vc = make([]byte, 8)
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+func pad(n int, b *big.Int) []byte {
+	ret := make([]byte, n)
+	buf := b.Bytes()
+	copy(ret[n-len(buf):], buf)
+	return ret
+}
+
+// newKey generate 160 bits private key and the public key
+func newKey() (*big.Int, []byte, error) {
+	var buf [20]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	private := new(big.Int).SetBytes(buf[:])
+	public := new(big.Int).Exp(generator, private, prime)
+	return private, pad(keySize, public), nil
+}
+
+// secret the shared secret S
+func secret(private *big.Int, remote []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(remote)
+	max := new(big.Int).Sub(prime, big.NewInt(1))
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(max) >= 0 {
+		return nil, errInvalidKey
+	}
+	return pad(keySize, new(big.Int).Exp(y, private, prime)), nil
+}
+
+// newCipher rc4 cipher with the first 1024 bytes discarded
+func newCipher(key []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(key)
+	var discard [1024]byte
+	c.XORKeyStream(discard[:], discard[:])
+	return c
+}
+
+func randomPad() ([]byte, error) {
+	buf := make([]byte, mrand.Intn(maxPad+1))
+	_, err := rand.Read(buf)
+	return buf, err
+}
+
+func selectCrypto(provide uint32, policy Policy) uint32 {
+	switch {
+	case policy == PolicyPlaintext && provide&cryptoPlaintext != 0:
+		return cryptoPlaintext
+	case policy != PolicyPlaintext && provide&cryptoRC4 != 0:
+		return cryptoRC4
+	case policy == PolicyPrefer && provide&cryptoPlaintext != 0:
+		return cryptoPlaintext
+	}
+	return 0
+}
+
+// stream read from connection with the bytes read ahead
+type stream struct {
+	conn net.Conn
+	buf  []byte
+}
+
+func (s *stream) more() error {
+	var tmp [1024]byte
+	n, err := s.conn.Read(tmp[:])
+	if err != nil {
+		return err
+	}
+	s.buf = append(s.buf, tmp[:n]...)
+	return nil
+}
+
+func (s *stream) readFull(n int) ([]byte, error) {
+	for len(s.buf) < n {
+		if err := s.more(); err != nil {
+			return nil, err
+		}
+	}
+	ret := append([]byte(nil), s.buf[:n]...)
+	s.buf = s.buf[n:]
+	return ret, nil
+}
+
+// skipTo drop the bytes until pattern in max bytes of padding
+func (s *stream) skipTo(pattern []byte, max int, notFound error) error {
+	for {
+		if i := bytes.Index(s.buf, pattern); i >= 0 {
+			s.buf = s.buf[i+len(pattern):]
+			return nil
+		}
+		if len(s.buf) >= max+len(pattern) {
+			return notFound
+		}
+		if err := s.more(); err != nil {
+			return err
+		}
+	}
+}
+
+// Client handshake as the connection initiator, skey is the info_hash,
+// the connection is returned as is when policy is PolicyPlaintext.
+// the caller should set deadline of c
+func Client(c net.Conn, skey []byte, policy Policy) (net.Conn, error) {
+	if policy == PolicyPlaintext {
+		return c, nil
+	}
+	provide := cryptoRC4
+	if policy == PolicyPrefer {
+		provide |= cryptoPlaintext
+	}
+	private, public, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	padA, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	// 1 A->B: Diffie Hellman Ya, PadA
+	_, err = c.Write(append(public, padA...))
+	if err != nil {
+		return nil, err
+	}
+	// 2 B->A: Diffie Hellman Yb, PadB
+	s := &stream{conn: c}
+	remote, err := s.readFull(keySize)
+	if err != nil {
+		return nil, err
+	}
+	S, err := secret(private, remote)
+	if err != nil {
+		return nil, err
+	}
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	enc := newCipher(hash([]byte("keyA"), S, skey))
+	dec := newCipher(hash([]byte("keyB"), S, skey))
+	req2 := hash([]byte("req2"), skey)
+	req3 := hash([]byte("req3"), S)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	body := make([]byte, 16)
+	copy(body, vc)
+	binary.BigEndian.PutUint32(body[8:], provide)
+	// empty PadC and IA
+	enc.XORKeyStream(body, body)
+	buf := append(hash([]byte("req1"), S), req2...)
+	_, err = c.Write(append(buf, body...))
+	if err != nil {
+		return nil, err
+	}
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD), ENCRYPT2(Payload Stream)
+	encVC := make([]byte, len(vc))
+	dec.XORKeyStream(encVC, vc)
+	err = s.skipTo(encVC, maxPad, errNoVC)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := s.readFull(6)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(hdr, hdr)
+	selected := binary.BigEndian.Uint32(hdr)
+	padD, err := s.readFull(int(binary.BigEndian.Uint16(hdr[4:])))
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padD, padD)
+	if selected != cryptoRC4 && (selected != cryptoPlaintext || provide&cryptoPlaintext == 0) {
+		return nil, errCrypto
+	}
+	return newConn(c, selected, enc, dec, nil, s.buf), nil
+}
+
+// Server handshake as the connection receiver, skeys are the acceptable info_hash,
+// returns the connection and the skey used by initiator
+func Server(c net.Conn, skeys [][]byte, policy Policy) (net.Conn, []byte, error) {
+	private, public, err := newKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	// 1 A->B: Diffie Hellman Ya, PadA
+	s := &stream{conn: c}
+	remote, err := s.readFull(keySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	S, err := secret(private, remote)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 2 B->A: Diffie Hellman Yb, PadB
+	padB, err := randomPad()
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = c.Write(append(public, padB...))
+	if err != nil {
+		return nil, nil, err
+	}
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	err = s.skipTo(hash([]byte("req1"), S), maxPad, errNoReq1)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := s.readFull(sha1.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+	req3 := hash([]byte("req3"), S)
+	for i := range req {
+		req[i] ^= req3[i]
+	}
+	var skey []byte
+	for _, key := range skeys {
+		if bytes.Equal(hash([]byte("req2"), key), req) {
+			skey = key
+			break
+		}
+	}
+	if skey == nil {
+		return nil, nil, errNoSKey
+	}
+	enc := newCipher(hash([]byte("keyB"), S, skey))
+	dec := newCipher(hash([]byte("keyA"), S, skey))
+	hdr, err := s.readFull(14)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec.XORKeyStream(hdr, hdr)
+	if !bytes.Equal(hdr[:8], vc) {
+		return nil, nil, errNoVC
+	}
+	provide := binary.BigEndian.Uint32(hdr[8:])
+	padC, err := s.readFull(int(binary.BigEndian.Uint16(hdr[12:])))
+	if err != nil {
+		return nil, nil, err
+	}
+	dec.XORKeyStream(padC, padC)
+	size, err := s.readFull(2)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec.XORKeyStream(size, size)
+	ia, err := s.readFull(int(binary.BigEndian.Uint16(size)))
+	if err != nil {
+		return nil, nil, err
+	}
+	dec.XORKeyStream(ia, ia)
+	selected := selectCrypto(provide, policy)
+	if selected == 0 {
+		return nil, nil, errCrypto
+	}
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD), ENCRYPT2(Payload Stream)
+	body := make([]byte, 14)
+	copy(body, vc)
+	binary.BigEndian.PutUint32(body[8:], selected)
+	enc.XORKeyStream(body, body)
+	_, err = c.Write(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newConn(c, selected, enc, dec, ia, s.buf), skey, nil
+}
+
+// Conn connection of payload stream after handshake
+type Conn struct {
+	net.Conn
+	enc     *rc4.Cipher // nil when plaintext
+	dec     *rc4.Cipher // nil when plaintext
+	pending []byte      // decrypted initial payload
+	raw     []byte      // read ahead in handshake
+}
+
+func newConn(c net.Conn, selected uint32, enc, dec *rc4.Cipher, pending, raw []byte) *Conn {
+	ret := &Conn{Conn: c, pending: pending, raw: raw}
+	if selected == cryptoRC4 {
+		ret.enc = enc
+		ret.dec = dec
+	}
+	return ret
+}
+
+// Encrypted the payload stream is encrypted by rc4
+func (c *Conn) Encrypted() bool {
+	return c.enc != nil
+}
+
+// Read read and decrypt data
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	var n int
+	var err error
+	if len(c.raw) > 0 {
+		n = copy(b, c.raw)
+		c.raw = c.raw[n:]
+	} else {
+		n, err = c.Conn.Read(b)
+	}
+	if c.dec != nil && n > 0 {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+// Write encrypt and write data
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
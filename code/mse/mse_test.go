@@ -0,0 +1,102 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// handshake run client and server handshake on loopback tcp connection
+func handshake(t *testing.T, clientPolicy, serverPolicy Policy, skey []byte) (net.Conn, net.Conn, error, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		sc, key, err := Server(c, [][]byte{[]byte("other"), []byte("skey")}, serverPolicy)
+		if err == nil && !bytes.Equal(key, []byte("skey")) {
+			t.Errorf("unexpected skey: %s", key)
+		}
+		if err != nil {
+			c.Close()
+		}
+		ch <- result{c: sc, err: err}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	cc, clientErr := Client(c, skey, clientPolicy)
+	if clientErr != nil {
+		c.Close()
+	}
+	ret := <-ch
+	return cc, ret.c, clientErr, ret.err
+}
+
+func checkStream(t *testing.T, a, b net.Conn) {
+	data := bytes.Repeat([]byte("BitTorrent protocol"), 1000)
+	go a.Write(data)
+	buf := make([]byte, len(data))
+	_, err := io.ReadFull(b, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	cc, sc, err1, err2 := handshake(t, PolicyRequire, PolicyPrefer, []byte("skey"))
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	defer cc.Close()
+	defer sc.Close()
+	if !cc.(*Conn).Encrypted() || !sc.(*Conn).Encrypted() {
+		t.Fatal("not encrypted")
+	}
+	checkStream(t, cc, sc)
+	checkStream(t, sc, cc)
+}
+
+func TestPlaintextSelected(t *testing.T) {
+	cc, sc, err1, err2 := handshake(t, PolicyPrefer, PolicyPlaintext, []byte("skey"))
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	defer cc.Close()
+	defer sc.Close()
+	if cc.(*Conn).Encrypted() || sc.(*Conn).Encrypted() {
+		t.Fatal("unexpected encrypted")
+	}
+	checkStream(t, cc, sc)
+	checkStream(t, sc, cc)
+}
+
+func TestRefused(t *testing.T) {
+	_, _, _, err := handshake(t, PolicyRequire, PolicyPlaintext, []byte("skey"))
+	if err != errCrypto {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, _, _, err = handshake(t, PolicyRequire, PolicyRequire, []byte("unknown"))
+	if err != errNoSKey {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,498 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const maxPayload = 1200        // keep packet under the common mtu
+const maxRecvBuf = 1024 * 1024 // advertised receive window
+const maxSendWindow = 64 * 1024
+const maxInbound = 1024 // max out of order packets
+const maxResend = 5
+const initRTO = time.Second
+const minRTO = 500 * time.Millisecond
+const maxRTO = 10 * time.Second
+const tickInterval = 100 * time.Millisecond
+const linger = 5 * time.Second // wait for fin of peer after closed
+
+var errClosed = errors.New("use of closed utp connection")
+var errReset = errors.New("utp connection reset by peer")
+var errResendTimeout = errors.New("utp connection resend timeout")
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type outPacket struct {
+	typ     byte
+	seq     uint16
+	payload []byte
+	sent    time.Time
+	count   int // transmissions
+}
+
+type inPacket struct {
+	typ     byte
+	payload []byte
+}
+
+// Conn utp connection, it implements net.Conn
+type Conn struct {
+	sync.Mutex
+	sock      *Socket
+	addr      *net.UDPAddr
+	recvID    uint16
+	sendID    uint16
+	seq       uint16 // next sequence number to send
+	ack       uint16 // last sequence number received in order
+	connected bool
+	outbound  []*outPacket // not acked packets ordered by seq
+	inflight  int          // not acked bytes
+	dupAck    int
+	inbound   map[uint16]inPacket // out of order packets
+	readBuf   []byte
+	eof       bool // fin of peer received
+	finSent   bool
+	closed    bool
+	closedAt  time.Time
+	err       error
+	peerWnd   uint32
+	tsDiff    uint32
+	srtt      time.Duration
+	rttvar    time.Duration
+	rto       time.Duration
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	chConnected chan struct{} // closed when connected
+	chRead      chan struct{}
+	chWrite     chan struct{}
+	done        chan struct{} // closed when failed or finished
+}
+
+func newConn(s *Socket, addr *net.UDPAddr, recvID, sendID uint16) *Conn {
+	return &Conn{
+		sock:        s,
+		addr:        addr,
+		recvID:      recvID,
+		sendID:      sendID,
+		inbound:     make(map[uint16]inPacket),
+		peerWnd:     maxPayload,
+		rto:         initRTO,
+		chConnected: make(chan struct{}),
+		chRead:      make(chan struct{}, 1),
+		chWrite:     make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// http://www.bittorrent.org/beps/bep_0029.html#connection-setup
+func (c *Conn) sendSyn() {
+	c.Lock()
+	defer c.Unlock()
+	c.seq = 1
+	p := &outPacket{typ: stSyn, seq: c.seq}
+	c.seq++
+	c.outbound = append(c.outbound, p)
+	c.transmit(p)
+}
+
+func (c *Conn) acceptSyn(hdr header) {
+	c.Lock()
+	defer c.Unlock()
+	c.seq = uint16(rand.Intn(65536))
+	c.ack = hdr.seq
+	c.peerWnd = hdr.wnd
+	c.connected = true
+	close(c.chConnected)
+	c.sendState()
+}
+
+func (c *Conn) recvWindow() uint32 {
+	if len(c.readBuf) >= maxRecvBuf {
+		return 0
+	}
+	return uint32(maxRecvBuf - len(c.readBuf))
+}
+
+func (c *Conn) send(typ byte, seq uint16, payload []byte) {
+	hdr := header{
+		typ:    typ,
+		connID: c.sendID,
+		ts:     c.sock.now(),
+		tsDiff: c.tsDiff,
+		wnd:    c.recvWindow(),
+		seq:    seq,
+		ack:    c.ack,
+	}
+	if typ == stSyn {
+		hdr.connID = c.recvID
+	}
+	c.sock.send(hdr.encode(payload), c.addr)
+}
+
+func (c *Conn) transmit(p *outPacket) {
+	p.sent = time.Now()
+	p.count++
+	c.send(p.typ, p.seq, p.payload)
+}
+
+func (c *Conn) sendState() {
+	c.send(stState, c.seq, nil)
+}
+
+// fail stop the connection, the loop goroutine removes it from socket
+func (c *Conn) fail(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+}
+
+func (c *Conn) abort(err error) {
+	c.Lock()
+	defer c.Unlock()
+	c.fail(err)
+}
+
+func (c *Conn) error() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.err
+}
+
+func (c *Conn) handle(hdr header, payload []byte, recvAt uint32) {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.tsDiff = recvAt - hdr.ts
+	c.peerWnd = hdr.wnd
+	notify(c.chWrite)
+	switch hdr.typ {
+	case stReset:
+		c.fail(errReset)
+		return
+	case stSyn:
+		// the state packet is lost
+		c.sendState()
+		return
+	}
+	if !c.connected {
+		// the data of peer is started from seq_nr of state packet
+		c.connected = true
+		c.ack = hdr.seq - 1
+		close(c.chConnected)
+	}
+	c.onAck(hdr.ack, hdr.typ == stState && len(payload) == 0)
+	if hdr.typ == stData || hdr.typ == stFin {
+		c.onData(hdr, payload)
+		c.sendState()
+	}
+}
+
+// onAck remove the acked packets, resend the first packet after 3 duplicate acks
+func (c *Conn) onAck(ack uint16, pure bool) {
+	acked := false
+	for len(c.outbound) > 0 && !seqLess(ack, c.outbound[0].seq) {
+		p := c.outbound[0]
+		if p.count == 1 {
+			c.updateRTT(time.Since(p.sent))
+		}
+		c.inflight -= len(p.payload)
+		c.outbound = c.outbound[1:]
+		acked = true
+	}
+	if acked {
+		c.dupAck = 0
+		notify(c.chWrite)
+		return
+	}
+	if pure && len(c.outbound) > 0 && ack == c.outbound[0].seq-1 {
+		c.dupAck++
+		if c.dupAck == 3 {
+			c.transmit(c.outbound[0])
+		}
+	}
+}
+
+func (c *Conn) updateRTT(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		delta := c.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = c.srtt + 4*c.rttvar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+}
+
+// onData deliver the data and fin packets in order
+func (c *Conn) onData(hdr header, payload []byte) {
+	if c.eof || !seqLess(c.ack, hdr.seq) || hdr.seq-c.ack > maxInbound {
+		// duplicate or too far
+		return
+	}
+	c.inbound[hdr.seq] = inPacket{
+		typ:     hdr.typ,
+		payload: append([]byte(nil), payload...),
+	}
+	for {
+		p, ok := c.inbound[c.ack+1]
+		if !ok {
+			break
+		}
+		delete(c.inbound, c.ack+1)
+		c.ack++
+		if p.typ == stFin {
+			c.eof = true
+			c.inbound = make(map[uint16]inPacket)
+			break
+		}
+		c.readBuf = append(c.readBuf, p.payload...)
+	}
+	notify(c.chRead)
+}
+
+// loop resend the timeout packets and remove connection from socket when finished
+func (c *Conn) loop() {
+	defer c.sock.remove(c)
+	tk := time.NewTicker(tickInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			c.check()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Conn) check() {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return
+	}
+	now := time.Now()
+	if c.closed && ((len(c.outbound) == 0 && c.eof) || now.Sub(c.closedAt) > linger) {
+		c.fail(errClosed)
+		return
+	}
+	resent := false
+	for _, p := range c.outbound {
+		if now.Sub(p.sent) < c.rto {
+			continue
+		}
+		if p.count > maxResend {
+			c.fail(errResendTimeout)
+			return
+		}
+		c.transmit(p)
+		resent = true
+	}
+	if resent {
+		c.rto *= 2
+		if c.rto > maxRTO {
+			c.rto = maxRTO
+		}
+	}
+}
+
+// wait wait for notify or deadline, returns false when timeout
+func (c *Conn) wait(ch chan struct{}, deadline time.Time) bool {
+	if deadline.IsZero() {
+		select {
+		case <-ch:
+		case <-c.done:
+		}
+		return true
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return false
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ch:
+	case <-c.done:
+	case <-t.C:
+		return false
+	}
+	return true
+}
+
+// Read read data
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.Lock()
+		if c.closed {
+			c.Unlock()
+			return 0, errClosed
+		}
+		if len(c.readBuf) > 0 {
+			before := len(c.readBuf)
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if len(c.readBuf) == 0 {
+				c.readBuf = nil
+			}
+			// window update for the blocked peer
+			if before >= maxRecvBuf/2 && len(c.readBuf) < maxRecvBuf/2 && c.err == nil {
+				c.sendState()
+			}
+			c.Unlock()
+			return n, nil
+		}
+		if c.eof {
+			c.Unlock()
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			err := c.err
+			c.Unlock()
+			return 0, err
+		}
+		deadline := c.readDeadline
+		c.Unlock()
+		if !c.wait(c.chRead, deadline) {
+			return 0, timeoutError{}
+		}
+	}
+}
+
+// Write write data
+func (c *Conn) Write(b []byte) (int, error) {
+	total := 0
+	for len(b) > 0 {
+		c.Lock()
+		if c.closed {
+			c.Unlock()
+			return total, errClosed
+		}
+		if c.err != nil {
+			err := c.err
+			c.Unlock()
+			return total, err
+		}
+		n := len(b)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		window := int(c.peerWnd)
+		if window > maxSendWindow {
+			window = maxSendWindow
+		}
+		// always allow one packet to probe the zero window
+		if len(c.outbound) == 0 || c.inflight+n <= window {
+			p := &outPacket{
+				typ:     stData,
+				seq:     c.seq,
+				payload: append([]byte(nil), b[:n]...),
+			}
+			c.seq++
+			c.outbound = append(c.outbound, p)
+			c.inflight += n
+			c.transmit(p)
+			c.Unlock()
+			b = b[n:]
+			total += n
+			continue
+		}
+		deadline := c.writeDeadline
+		c.Unlock()
+		if !c.wait(c.chWrite, deadline) {
+			return total, timeoutError{}
+		}
+	}
+	return total, nil
+}
+
+// Close send fin to peer, the connection is kept until fin of peer
+// is received or linger timeout
+func (c *Conn) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return errClosed
+	}
+	c.closed = true
+	c.closedAt = time.Now()
+	if c.err != nil || !c.connected {
+		c.fail(errClosed)
+		return nil
+	}
+	if !c.finSent {
+		p := &outPacket{typ: stFin, seq: c.seq}
+		c.seq++
+		c.outbound = append(c.outbound, p)
+		c.transmit(p)
+		c.finSent = true
+	}
+	notify(c.chRead)
+	notify(c.chWrite)
+	return nil
+}
+
+// LocalAddr local address of udp socket
+func (c *Conn) LocalAddr() net.Addr {
+	return c.sock.local
+}
+
+// RemoteAddr remote address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline set read and write deadline
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline set read deadline
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.Lock()
+	c.readDeadline = t
+	c.Unlock()
+	notify(c.chRead)
+	return nil
+}
+
+// SetWriteDeadline set write deadline
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.Lock()
+	c.writeDeadline = t
+	c.Unlock()
+	notify(c.chWrite)
+	return nil
+}
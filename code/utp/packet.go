@@ -0,0 +1,82 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// http://www.bittorrent.org/beps/bep_0029.html#header-format
+const (
+	stData  = byte(0)
+	stFin   = byte(1)
+	stState = byte(2)
+	stReset = byte(3)
+	stSyn   = byte(4)
+)
+
+const version = byte(1)
+const headerSize = 20
+
+var errInvalidPacket = errors.New("invalid utp packet")
+
+type header struct {
+	typ    byte
+	connID uint16
+	ts     uint32 // timestamp_microseconds
+	tsDiff uint32 // timestamp_difference_microseconds
+	wnd    uint32
+	seq    uint16
+	ack    uint16
+}
+
+// IsPacket check packet type and version by the first byte,
+// the krpc packet is always started with 'd'
+func IsPacket(buf []byte) bool {
+	return len(buf) >= headerSize &&
+		buf[0]&0xf == version && buf[0]>>4 <= stSyn
+}
+
+func (h header) encode(payload []byte) []byte {
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = h.typ<<4 | version
+	buf[1] = 0 // no extension
+	binary.BigEndian.PutUint16(buf[2:], h.connID)
+	binary.BigEndian.PutUint32(buf[4:], h.ts)
+	binary.BigEndian.PutUint32(buf[8:], h.tsDiff)
+	binary.BigEndian.PutUint32(buf[12:], h.wnd)
+	binary.BigEndian.PutUint16(buf[16:], h.seq)
+	binary.BigEndian.PutUint16(buf[18:], h.ack)
+	copy(buf[headerSize:], payload)
+	return buf
+}
+
+// decode decode header and skip the extensions, returns the payload
+// http://www.bittorrent.org/beps/bep_0029.html#extension
+func decode(buf []byte) (header, []byte, error) {
+	var h header
+	if !IsPacket(buf) {
+		return h, nil, errInvalidPacket
+	}
+	h.typ = buf[0] >> 4
+	h.connID = binary.BigEndian.Uint16(buf[2:])
+	h.ts = binary.BigEndian.Uint32(buf[4:])
+	h.tsDiff = binary.BigEndian.Uint32(buf[8:])
+	h.wnd = binary.BigEndian.Uint32(buf[12:])
+	h.seq = binary.BigEndian.Uint16(buf[16:])
+	h.ack = binary.BigEndian.Uint16(buf[18:])
+	ext := buf[1]
+	payload := buf[headerSize:]
+	for ext != 0 {
+		if len(payload) < 2 || len(payload) < 2+int(payload[1]) {
+			return h, nil, errInvalidPacket
+		}
+		ext = payload[0]
+		payload = payload[2+int(payload[1]):]
+	}
+	return h, payload, nil
+}
+
+// seqLess a is before b in wrapping sequence numbers
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
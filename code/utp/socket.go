@@ -0,0 +1,175 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var errSocketClosed = errors.New("utp socket closed")
+
+type connKey struct {
+	addr string
+	id   uint16 // receive connection id
+}
+
+// Socket utp connections over a shared udp socket, the packets are read by
+// the owner of udp socket and passed to Handle
+// http://www.bittorrent.org/beps/bep_0029.html
+type Socket struct {
+	sync.Mutex
+	send   func([]byte, *net.UDPAddr) error
+	local  net.Addr
+	conns  map[connKey]*Conn
+	accept chan *Conn // nil when not accept incoming connections
+	closed bool
+	start  time.Time
+}
+
+// NewSocket create utp socket, send is used to write packets to udp socket,
+// the incoming connections are refused when backlog is 0
+func NewSocket(send func([]byte, *net.UDPAddr) error, local net.Addr, backlog int) *Socket {
+	s := &Socket{
+		send:  send,
+		local: local,
+		conns: make(map[connKey]*Conn),
+		start: time.Now(),
+	}
+	if backlog > 0 {
+		s.accept = make(chan *Conn, backlog)
+	}
+	return s
+}
+
+// now timestamp in microseconds
+func (s *Socket) now() uint32 {
+	return uint32(time.Since(s.start) / time.Microsecond)
+}
+
+// Handle handle the utp packet read from udp socket, returns false when it is not utp packet
+func (s *Socket) Handle(addr *net.UDPAddr, buf []byte) bool {
+	hdr, payload, err := decode(buf)
+	if err != nil {
+		return false
+	}
+	recvAt := s.now()
+	key := connKey{addr: addr.String(), id: hdr.connID}
+	if hdr.typ == stSyn {
+		key.id++
+	}
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return true
+	}
+	c := s.conns[key]
+	if c == nil && hdr.typ == stSyn && s.accept != nil {
+		c = newConn(s, addr, key.id, hdr.connID)
+		c.acceptSyn(hdr)
+		select {
+		case s.accept <- c:
+			s.conns[key] = c
+			go c.loop()
+		default:
+			// backlog is full
+			c = nil
+		}
+	}
+	s.Unlock()
+	if c == nil {
+		if hdr.typ != stReset {
+			s.reset(addr, hdr)
+		}
+		return true
+	}
+	c.handle(hdr, payload, recvAt)
+	return true
+}
+
+// reset refuse the packet of unknown connection
+func (s *Socket) reset(addr *net.UDPAddr, hdr header) {
+	rst := header{
+		typ:    stReset,
+		connID: hdr.connID,
+		ts:     s.now(),
+		seq:    uint16(rand.Intn(65536)),
+		ack:    hdr.seq,
+	}
+	s.send(rst.encode(nil), addr)
+}
+
+// Dial connect to addr by utp
+func (s *Socket) Dial(ctx context.Context, addr *net.UDPAddr) (net.Conn, error) {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return nil, errSocketClosed
+	}
+	key := connKey{addr: addr.String()}
+	for {
+		key.id = uint16(rand.Intn(65536))
+		// the send id is id+1, which should not be used by any connection
+		if s.conns[key] == nil && s.conns[connKey{addr: key.addr, id: key.id + 1}] == nil {
+			break
+		}
+	}
+	c := newConn(s, addr, key.id, key.id+1)
+	s.conns[key] = c
+	s.Unlock()
+	c.sendSyn()
+	go c.loop()
+	select {
+	case <-c.chConnected:
+		return c, nil
+	case <-c.done:
+		return nil, c.error()
+	case <-ctx.Done():
+		c.abort(ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+// Accept accept the incoming connection
+func (s *Socket) Accept() (net.Conn, error) {
+	if s.accept == nil {
+		return nil, errors.New("utp socket is not accepting")
+	}
+	c, ok := <-s.accept
+	if !ok {
+		return nil, errSocketClosed
+	}
+	return c, nil
+}
+
+// Close close all connections
+func (s *Socket) Close() {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return
+	}
+	s.closed = true
+	conns := make([]*Conn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	if s.accept != nil {
+		close(s.accept)
+	}
+	s.Unlock()
+	for _, c := range conns {
+		c.abort(errSocketClosed)
+	}
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.Lock()
+	defer s.Unlock()
+	key := connKey{addr: c.addr.String(), id: c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
@@ -0,0 +1,139 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestSocket utp socket on udp socket of localhost, loss is the drop rate of sending packets
+func newTestSocket(t *testing.T, backlog int, loss float64) (*Socket, *net.UDPConn) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	s := NewSocket(func(buf []byte, addr *net.UDPAddr) error {
+		if rnd.Float64() < loss {
+			return nil
+		}
+		_, err := conn.WriteToUDP(buf, addr)
+		return err
+	}, conn.LocalAddr(), backlog)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			s.Handle(addr, append([]byte(nil), buf[:n]...))
+		}
+	}()
+	return s, conn
+}
+
+func testEcho(t *testing.T, loss float64) {
+	server, serverConn := newTestSocket(t, 1, loss)
+	defer serverConn.Close()
+	defer server.Close()
+	client, clientConn := newTestSocket(t, 0, loss)
+	defer clientConn.Close()
+	defer client.Close()
+
+	go func() {
+		c, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := client.Dial(ctx, serverConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	data := make([]byte, 200*1024)
+	rand.Read(data)
+	go func() {
+		c.Write(data)
+	}()
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(c, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func TestEcho(t *testing.T) {
+	testEcho(t, 0)
+}
+
+func TestEchoLoss(t *testing.T) {
+	testEcho(t, 0.05)
+}
+
+func TestClose(t *testing.T) {
+	server, serverConn := newTestSocket(t, 1, 0)
+	defer serverConn.Close()
+	defer server.Close()
+	client, clientConn := newTestSocket(t, 0, 0)
+	defer clientConn.Close()
+	defer client.Close()
+
+	go func() {
+		c, err := server.Accept()
+		if err != nil {
+			return
+		}
+		c.Write([]byte("hello"))
+		c.Close()
+	}()
+	c, err := client.Dial(context.Background(), serverConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("unexpected data: %s", data)
+	}
+}
+
+func TestRefused(t *testing.T) {
+	server, serverConn := newTestSocket(t, 0, 0)
+	defer serverConn.Close()
+	defer server.Close()
+	client, clientConn := newTestSocket(t, 0, 0)
+	defer clientConn.Close()
+	defer client.Close()
+
+	_, err := client.Dial(context.Background(), serverConn.LocalAddr().(*net.UDPAddr))
+	if err != errReset {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	// no response
+	_, err = client.Dial(ctx, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}